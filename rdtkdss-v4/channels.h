@@ -2,6 +2,13 @@ bool ina240_debug = false;
 int ina240_hysteresis_delay_ms = 100;
 int ina240_offset = -511;
 int ina240_threshold = 8;
+// The INA240 outputs current * shunt * gain; calibrate these for the board.
+long ina240_gain = 20;
+long ina240_shunt_mohm = 100;
+#define ADC_UV_PER_COUNT 4883 // 5 V / 1024
+// Currents are reported at most every report_interval_ms, when one changed by more than report_delta_ma.
+unsigned long report_interval_ms = 250; // a report of 16 lines takes about 100 ms at 9600 baud
+int report_delta_ma = 5;
 
 struct channel {
   char name;
@@ -18,6 +25,9 @@ struct channel {
   bool tf_now;
   unsigned long _hys_until;
 
+  // peak_ma is the highest current since the last report.
+  int peak_ma;
+
   int _prev_power;
 };
 
@@ -116,6 +126,9 @@ void channels_updateSensors() {
     }
     c->val = val;
     c->tf_now = tf_now;
+    int ma = (long) abs(val + ina240_offset) * ADC_UV_PER_COUNT / (ina240_gain * ina240_shunt_mohm);
+    if (ma > c->peak_ma)
+      c->peak_ma = ma;
     if (ina240_debug) {
       Serial.print(i);
       Serial.print(" val");
@@ -126,33 +139,43 @@ void channels_updateSensors() {
   }
 }
 
-void channels_sendDelta() {
-  static bool values[channels_len] = {0};
+// channels_sendCurrents reports the peak current of each line (the host decides whether lines are occupied).
+void channels_sendCurrents() {
+  static int sent_ma[channels_len] = {0};
+  static unsigned long sent_ms = 0;
+  unsigned long now = millis();
+  if (now - sent_ms < report_interval_ms)
+    return;
+  sent_ms = now;
   bool changed = false;
   for (int i = 0; i < channels_len; i ++) {
-    struct channel *c = &channels[i];
-    if (c->tf_now != values[i]) changed = true;
-    values[i] = c->tf_now;
+    int peak_ma = channels[i].peak_ma;
+    if (abs(peak_ma - sent_ma[i]) > report_delta_ma || (peak_ma == 0) != (sent_ma[i] == 0))
+      changed = true;
   }
 
   if (ina240_debug) {
-    Serial.print("values ");
+    Serial.print("peaks ");
     for (int i = 0; i < channels_len; i ++) {
-      Serial.print(values[i]);
+      Serial.print(channels[i].peak_ma);
+      Serial.print(" ");
     }
     Serial.println();
   }
 
-  //if (!changed && !ina240_debug) return;
   if (changed) {
-    Serial.print(" DC");
+    Serial.print(" DI");
     for (int i = 0; i < channels_len; i ++) {
-      struct channel c = channels[i];
       Serial.print((char) ('A'+i));
-      Serial.print(c.tf_now);
+      Serial.print(channels[i].peak_ma);
+      Serial.print(" ");
+      sent_ma[i] = channels[i].peak_ma;
     }
     Serial.print("T");
-    Serial.println(millis());
+    Serial.println(now);
+  }
+  for (int i = 0; i < channels_len; i ++) {
+    channels[i].peak_ma = 0;
   }
 }
 
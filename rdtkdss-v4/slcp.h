@@ -36,30 +36,98 @@ void setup() {
 }
 
 void handleSLCP();
+void heartbeat_update();
 
 void loop() {
   channels_updateSensors();
-  channels_sendDelta();
+  channels_sendCurrents();
   channels_stop_update();
+  heartbeat_update();
   handleSLCP();
 }
 
+// After the first ping (P), all channels are turned off if no ping is received for heartbeat_timeout_ms (e.g. the host crashed).
+bool heartbeat_armed = false;
+unsigned long heartbeat_last_ms = 0;
+unsigned long heartbeat_timeout_ms = 0;
+
+void heartbeat_update() {
+  if (!heartbeat_armed || millis() - heartbeat_last_ms <= heartbeat_timeout_ms)
+    return;
+  heartbeat_armed = false;
+  for (int i = 0; i < channels_len; i ++) {
+    channel_write(&channels[i], 0);
+    channels[i].stop_ms = 0;
+  }
+  Serial.println(" Efailsafe: no heartbeat");
+}
+
+void handlePing() {
+  // P02000
+  char buf[5+1+1] = {0};
+  if (6 != Serial.readBytes(buf, 6)) {
+    Serial.println(" Eserial timeout");
+    return;
+  }
+  if (buf[5] != '\n') {
+    Serial.println(" Eexpected EOL at end");
+    return;
+  }
+  buf[5] = '\0';
+  heartbeat_timeout_ms = atol(buf);
+  heartbeat_last_ms = millis();
+  heartbeat_armed = true;
+  Serial.print(" PT");
+  Serial.println(heartbeat_last_ms);
+}
+
+// replyError reports an error in a command. Commands with a sequence number are rejected (X) instead.
+void replyError(int seq, const char *message) {
+  if (seq == 0) {
+    Serial.print(" E");
+  } else {
+    char head[8];
+    snprintf(head, sizeof(head), " X%04d ", seq);
+    Serial.print(head);
+  }
+  Serial.println(message);
+}
+
 void handleChangeSwitch(bool isSwitch) {
   // CAAN000
   // SAAN000T00000N
-  char buf[6+7+1+1] = {0};
+  // optionally followed by a sequence number to acknowledge, e.g. CAAN000#0042
+  char buf[6+7+1+5+1] = {0};
   int length = isSwitch ? 6+7+1 : 6+1;
   if (length != Serial.readBytes(buf, length)) {
     Serial.println(" Eserial timeout");
     return;
   }
+  int seq = 0;
+  if (buf[length-1] == '#') {
+    if (5 != Serial.readBytes(buf+length, 5)) {
+      Serial.println(" Eserial timeout");
+      return;
+    }
+    buf[length+4] = '\0';
+    seq = atoi(buf+length);
+    buf[length+4] = '\n';
+    length += 5;
+    if (seq <= 0 || seq > 9999) {
+      Serial.println(" Einvalid sequence number");
+      return;
+    }
+  }
   if (buf[length-1] != '\n') {
-    Serial.println(" Eexpected EOL at end");
+    replyError(seq, "expected EOL at end");
+    if (seq != 0)
+      return;
   }
   int i = buf[0] - 'A';
   if (i < 0 || i >= channels_len) {
-    Serial.print(" Einvalid line ");
-    Serial.println(buf[1]);
+    Serial.print("debug invalid line ");
+    Serial.println(buf[0]);
+    replyError(seq, "invalid line");
     return;
   }
   struct channel *c = &channels[i];
@@ -71,13 +139,14 @@ void handleChangeSwitch(bool isSwitch) {
   int power = atoi(buf+3);
   buf[3+3] = tmp;
   if (power < 0 || power > 255) {
-    Serial.println(" Eout of range");
+    replyError(seq, "out of range");
     return;
   };
   if (isSwitch) {
     if (buf[6] != 'T') {
-      Serial.print(" Eread short: literal 'T' expected, got ");
+      Serial.print("debug read short: literal 'T' expected, got ");
       Serial.println(buf[6], HEX);
+      replyError(seq, "expected T");
       return;
     }
     buf[7+5] = '\0';
@@ -93,6 +162,11 @@ void handleChangeSwitch(bool isSwitch) {
   Serial.print(" to ");
   Serial.print('A'+i);
   Serial.println(".");
+  if (seq != 0) {
+    char ack[8];
+    snprintf(ack, sizeof(ack), " A%04d", seq);
+    Serial.println(ack);
+  }
   return;
 }
 
@@ -104,7 +178,9 @@ void handleSLCP() {
   int kind = Serial.read();
   if (kind == 'I') {
     Serial.print(" Isoyuu-kdss/" VARIANT "/");
-    Serial.println(instance);
+    Serial.print(instance);
+    // capabilities (see sakayukari/conn/hlcp)
+    Serial.println(" +ack +heartbeat");
     int eol = Serial.read();
     if (eol != '\n') {
       Serial.println(" Eexpected eol");
@@ -113,6 +189,8 @@ void handleSLCP() {
     handleChangeSwitch(true);
   } else if (kind == 'C') {
     handleChangeSwitch(false);
+  } else if (kind == 'P') {
+    handlePing();
   } else if (kind == 'L') {
     buffer[0] = Serial.read();
     buffer[1] = Serial.read();
@@ -0,0 +1,170 @@
+package sakayukari
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Builder builds a Graph from actors registered under names.
+// Refs of actors can be obtained by name before the actors are added, so actors can refer to each other regardless of the order they are added in.
+type Builder struct {
+	refs   map[string]ActorRef
+	names  []string
+	actors []*Actor
+	// inputs has the names of inputs given to Add, for each actor.
+	inputs [][]string
+	errs   []error
+}
+
+// NewBuilder returns an empty Builder.
+// Index 0 is reserved for a placeholder actor, as a Diffuse1 with a zero Origin is treated as published by the sender, so the actor at index 0 cannot be set by other actors.
+func NewBuilder() *Builder {
+	b := &Builder{refs: map[string]ActorRef{}}
+	b.names = append(b.names, "")
+	b.actors = append(b.actors, &Actor{
+		Comment:  "placeholder",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	})
+	b.inputs = append(b.inputs, nil)
+	return b
+}
+
+// Ref returns the ref for the actor named name, reserving one if the actor was not added yet.
+func (b *Builder) Ref(name string) ActorRef {
+	ref, ok := b.refs[name]
+	if ok {
+		return ref
+	}
+	ref = ActorRef{Index: len(b.actors)}
+	b.refs[name] = ref
+	b.names = append(b.names, name)
+	b.actors = append(b.actors, nil)
+	b.inputs = append(b.inputs, nil)
+	return ref
+}
+
+// Add adds a under name, with the named actors appended to a.Inputs.
+// If a.Comment is empty, name is used.
+func (b *Builder) Add(name string, a Actor, inputs ...string) ActorRef {
+	ref := b.Ref(name)
+	if b.actors[ref.Index] != nil {
+		b.errs = append(b.errs, fmt.Errorf("actor %s: added more than once", name))
+		return ref
+	}
+	if a.Comment == "" {
+		a.Comment = name
+	}
+	b.actors[ref.Index] = &a
+	b.inputs[ref.Index] = inputs
+	return ref
+}
+
+// Name returns the name of the actor at ref.
+func (b *Builder) Name(ref ActorRef) (name string, ok bool) {
+	if ref.Index <= 0 || ref.Index >= len(b.names) {
+		return "", false
+	}
+	return b.names[ref.Index], true
+}
+
+// Build resolves inputs, and returns the Graph.
+// An error is returned if an actor was added more than once, an actor was referred to but not added, or the inputs of actors have a cycle.
+func (b *Builder) Build() (*Graph, error) {
+	errs := append([]error(nil), b.errs...)
+	missing := map[string]bool{}
+	for j, name := range b.names {
+		if b.actors[j] == nil {
+			missing[name] = true
+		}
+	}
+	g := &Graph{Actors: make([]Actor, len(b.actors))}
+	for j, a := range b.actors {
+		if a == nil {
+			continue
+		}
+		actor := *a
+		actor.Inputs = append([]ActorRef(nil), actor.Inputs...)
+		for _, input := range b.inputs[j] {
+			ref, ok := b.refs[input]
+			if !ok || b.actors[ref.Index] == nil {
+				missing[input] = true
+				continue
+			}
+			actor.Inputs = append(actor.Inputs, ref)
+		}
+		for _, input := range actor.Inputs {
+			// the placeholder is allowed, as a zero ActorRef is often used for an unused input
+			if input.Index < 0 || input.Index >= len(b.actors) {
+				errs = append(errs, fmt.Errorf("actor %s: input %s out of range", b.names[j], input))
+			}
+		}
+		g.Actors[j] = actor
+	}
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			errs = append(errs, fmt.Errorf("actor %s: referred to but not added", name))
+		}
+	}
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for k, err := range errs {
+			msgs[k] = err.Error()
+		}
+		return nil, errors.New(strings.Join(msgs, "; "))
+	}
+	if cycle := b.findCycle(g); cycle != nil {
+		return nil, fmt.Errorf("inputs have a cycle: %v", cycle)
+	}
+	return g, nil
+}
+
+// findCycle returns the names of actors in a cycle of inputs, or nil if there are no cycles.
+func (b *Builder) findCycle(g *Graph) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make([]int, len(g.Actors))
+	var stack []int
+	var visit func(j int) []string
+	visit = func(j int) []string {
+		switch states[j] {
+		case visiting:
+			var cycle []string
+			for k := len(stack) - 1; k >= 0; k-- {
+				cycle = append([]string{b.names[stack[k]]}, cycle...)
+				if stack[k] == j {
+					break
+				}
+			}
+			return append(cycle, b.names[j])
+		case visited:
+			return nil
+		}
+		states[j] = visiting
+		stack = append(stack, j)
+		for _, input := range g.Actors[j].Inputs {
+			if cycle := visit(input.Index); cycle != nil {
+				return cycle
+			}
+		}
+		stack = stack[:len(stack)-1]
+		states[j] = visited
+		return nil
+	}
+	for j := range g.Actors {
+		if cycle := visit(j); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package sakayukari
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuilder(t *testing.T) {
+	output := func() Actor {
+		return Actor{OutputCh: make(chan Diffuse1), Type: ActorType{Output: true}}
+	}
+	input := func(inputs ...ActorRef) Actor {
+		return Actor{InputCh: make(chan Diffuse1), Inputs: inputs, Type: ActorType{Input: true}}
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		b := NewBuilder()
+		// refer to sensor before it is added
+		b.Add("model", input(b.Ref("sensor")), "guide")
+		b.Add("guide", input(), "sensor")
+		sensor := b.Add("sensor", output())
+		g, err := b.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sensor.Index == 0 {
+			t.Fatal("index 0 must not be used")
+		}
+		got := map[string][]ActorRef{}
+		for j, a := range g.Actors[1:] {
+			name, _ := b.Name(ActorRef{Index: j + 1})
+			got[name] = a.Inputs
+		}
+		want := map[string][]ActorRef{
+			"model":  {sensor, b.Ref("guide")},
+			"guide":  {sensor},
+			"sensor": nil,
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("inputs (-want +got):\n%s", diff)
+		}
+		if g.Actors[sensor.Index].Comment != "sensor" {
+			t.Fatalf("comment: %s", g.Actors[sensor.Index].Comment)
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		b := NewBuilder()
+		b.Add("model", input(b.Ref("sensor")), "guide")
+		_, err := b.Build()
+		if err == nil || !strings.Contains(err.Error(), "actor guide:") || !strings.Contains(err.Error(), "actor sensor:") {
+			t.Fatalf("err: %v", err)
+		}
+	})
+	t.Run("duplicate", func(t *testing.T) {
+		b := NewBuilder()
+		b.Add("sensor", output())
+		b.Add("sensor", output())
+		_, err := b.Build()
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	})
+	t.Run("cycle", func(t *testing.T) {
+		b := NewBuilder()
+		b.Add("a", input(), "b")
+		b.Add("b", input(), "c")
+		b.Add("c", input(), "a")
+		_, err := b.Build()
+		if err == nil || !strings.Contains(err.Error(), "cycle") {
+			t.Fatalf("err: %v", err)
+		}
+	})
+}
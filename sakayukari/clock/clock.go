@@ -0,0 +1,129 @@
+// Package clock provides clocks that can be injected in place of the time package, so e.g. simulations can run faster than real time, or deterministically in tests.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time, and makes timers.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) *Timer
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Or returns c, or Real if c is nil.
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+// Timer is like time.Timer.
+type Timer struct {
+	C    <-chan time.Time
+	stop func() bool
+}
+
+// Stop is like time.Timer.Stop.
+func (t *Timer) Stop() bool { return t.stop() }
+
+// Ticker is like time.Ticker.
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+// Stop is like time.Ticker.Stop.
+func (t *Ticker) Stop() { t.stop() }
+
+// Real is the clock of the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTimer(d time.Duration) *Timer {
+	t := time.NewTimer(d)
+	return &Timer{C: t.C, stop: t.Stop}
+}
+
+func (realClock) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{C: t.C, stop: t.Stop}
+}
+
+// Scaled is a clock that runs speed times faster than real time, starting from the real time when it was made.
+type Scaled struct {
+	start time.Time
+	speed float64
+}
+
+// NewScaled returns a clock that runs speed times faster than real time.
+func NewScaled(speed float64) *Scaled {
+	if speed <= 0 {
+		panic("speed must be positive")
+	}
+	return &Scaled{start: time.Now(), speed: speed}
+}
+
+func (s *Scaled) real(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / s.speed)
+}
+
+func (s *Scaled) Now() time.Time {
+	return s.start.Add(time.Duration(float64(time.Since(s.start)) * s.speed))
+}
+
+func (s *Scaled) Since(t time.Time) time.Duration { return s.Now().Sub(t) }
+func (s *Scaled) Sleep(d time.Duration)           { time.Sleep(s.real(d)) }
+
+func (s *Scaled) After(d time.Duration) <-chan time.Time {
+	return s.NewTimer(d).C
+}
+
+func (s *Scaled) NewTimer(d time.Duration) *Timer {
+	ch := make(chan time.Time, 1)
+	t := time.AfterFunc(s.real(d), func() {
+		select {
+		case ch <- s.Now():
+		default:
+		}
+	})
+	return &Timer{C: ch, stop: t.Stop}
+}
+
+func (s *Scaled) NewTicker(d time.Duration) *Ticker {
+	ch := make(chan time.Time, 1)
+	t := time.NewTicker(s.real(d))
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			}
+			select {
+			case ch <- s.Now():
+			default:
+			}
+		}
+	}()
+	var once sync.Once
+	return &Ticker{C: ch, stop: func() {
+		once.Do(func() {
+			t.Stop()
+			close(done)
+		})
+	}}
+}
@@ -0,0 +1,125 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Virtual is a clock that only moves when Advance is called, so tests are deterministic and do not wait in real time.
+// Like the time package, a timer or ticker does not block if its channel is not received from; ticks are dropped instead.
+type Virtual struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*waiter
+	seq     int
+}
+
+type waiter struct {
+	at time.Time
+	// period is the period of a ticker, or 0 for timers.
+	period time.Duration
+	ch     chan time.Time
+	// seq orders waiters with the same at by when they were made.
+	seq int
+}
+
+// NewVirtual returns a Virtual clock starting at start.
+func NewVirtual(start time.Time) *Virtual {
+	v := &Virtual{now: start}
+	v.cond = sync.NewCond(&v.lock)
+	return v
+}
+
+func (v *Virtual) Now() time.Time {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.now
+}
+
+func (v *Virtual) Since(t time.Time) time.Duration { return v.Now().Sub(t) }
+
+func (v *Virtual) Sleep(d time.Duration) { <-v.After(d) }
+
+func (v *Virtual) After(d time.Duration) <-chan time.Time { return v.NewTimer(d).C }
+
+func (v *Virtual) NewTimer(d time.Duration) *Timer {
+	w := v.add(d, 0)
+	return &Timer{C: w.ch, stop: func() bool { return v.remove(w) }}
+}
+
+func (v *Virtual) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	w := v.add(d, d)
+	return &Ticker{C: w.ch, stop: func() { v.remove(w) }}
+}
+
+func (v *Virtual) add(d, period time.Duration) *waiter {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	w := &waiter{at: v.now.Add(d), period: period, ch: make(chan time.Time, 1), seq: v.seq}
+	v.seq++
+	if d <= 0 && period == 0 {
+		w.ch <- v.now
+		return w
+	}
+	v.waiters = append(v.waiters, w)
+	v.cond.Broadcast()
+	return w
+}
+
+func (v *Virtual) remove(w *waiter) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for j, w2 := range v.waiters {
+		if w2 == w {
+			v.waiters = append(v.waiters[:j], v.waiters[j+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward by d, firing timers and tickers in order.
+func (v *Virtual) Advance(d time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	end := v.now.Add(d)
+	for {
+		sort.Slice(v.waiters, func(a, b int) bool {
+			wa, wb := v.waiters[a], v.waiters[b]
+			if !wa.at.Equal(wb.at) {
+				return wa.at.Before(wb.at)
+			}
+			return wa.seq < wb.seq
+		})
+		if len(v.waiters) == 0 || v.waiters[0].at.After(end) {
+			break
+		}
+		w := v.waiters[0]
+		v.now = w.at
+		select {
+		case w.ch <- v.now:
+		default:
+		}
+		if w.period == 0 {
+			v.waiters = v.waiters[1:]
+		} else {
+			w.at = w.at.Add(w.period)
+		}
+	}
+	v.now = end
+}
+
+// BlockUntil blocks until at least n timers and tickers are waiting to fire.
+// This is useful to wait until goroutines using v are waiting, before calling Advance.
+func (v *Virtual) BlockUntil(n int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for len(v.waiters) < n {
+		v.cond.Wait()
+	}
+}
@@ -0,0 +1,51 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVirtual(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	v := NewVirtual(start)
+	timer := v.NewTimer(150 * time.Millisecond)
+	ticker := v.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	v.Advance(99 * time.Millisecond)
+	select {
+	case <-timer.C:
+		t.Fatal("timer fired early")
+	case <-ticker.C:
+		t.Fatal("ticker fired early")
+	default:
+	}
+
+	v.Advance(1 * time.Millisecond)
+	if got := <-ticker.C; !got.Equal(start.Add(100 * time.Millisecond)) {
+		t.Fatalf("ticker: %s", got)
+	}
+	v.Advance(100 * time.Millisecond)
+	if got := <-timer.C; !got.Equal(start.Add(150 * time.Millisecond)) {
+		t.Fatalf("timer: %s", got)
+	}
+	if got := <-ticker.C; !got.Equal(start.Add(200 * time.Millisecond)) {
+		t.Fatalf("ticker: %s", got)
+	}
+	if timer.Stop() {
+		t.Fatal("fired timer stopped")
+	}
+	if got := v.Since(start); got != 200*time.Millisecond {
+		t.Fatalf("since: %s", got)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		v.Sleep(time.Hour)
+		close(done)
+	}()
+	// the ticker and the sleep
+	v.BlockUntil(2)
+	v.Advance(time.Hour)
+	<-done
+}
@@ -0,0 +1,73 @@
+// Command conn-export exports devices connected to this computer, so they can be used by e.g. ctl2 -remote on another computer.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/conn"
+	"nyiyui.ca/hato/sakayukari/runtime"
+)
+
+func main() {
+	listen := flag.String("listen", "0.0.0.0:8002", "address to listen on")
+	ids := flag.String("ids", "soyuu-kdss/v4/peach", "comma-separated ids of devices to export, in the same order as the importing side")
+	tcp := flag.String("tcp", "", "comma-separated addresses (host:port) of devices reachable over TCP, e.g. through ser2net")
+	capture := flag.String("capture", "", "capture all bytes sent to and received from devices into files in this directory (see conn-replay)")
+	flag.Parse()
+
+	connIds := make([]conn.Id, 0)
+	for _, id := range strings.Split(*ids, ",") {
+		connIds = append(connIds, conn.ParseId(id))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	b := NewBuilder()
+	connState, connActors := conn.ConnActors(connIds)
+	if *tcp != "" {
+		connState.SetNetworkDevices(strings.Split(*tcp, ","))
+	}
+	if *capture != "" {
+		connState.SetCaptureDir(*capture)
+	}
+	log.Printf("finding devices…")
+	err := connState.Find()
+	if err != nil {
+		log.Fatalf("conn find: %s", err)
+	}
+	go connState.Watch(ctx, conn.DefaultScanInterval)
+	refs := make([]ActorRef, len(connIds))
+	for j, id := range connIds {
+		refs[j] = b.Add("conn "+id.String(), connActors[j])
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("listen: %s", err)
+	}
+	b.Add("export", runtime.Export(runtime.ExportConf{
+		Listener: l,
+		Actors:   refs,
+	}))
+	g, err := b.Build()
+	if err != nil {
+		log.Fatalf("build graph: %s", err)
+	}
+
+	i := runtime.NewInstance(g, runtime.InstanceConf{})
+	err = i.Check()
+	if err != nil {
+		log.Fatalf("check: %s", err)
+	}
+	log.Printf("exporting on %s…", l.Addr())
+	err = i.Diffuse(ctx)
+	if err != nil {
+		log.Fatalf("diffuse: %s", err)
+	}
+}
@@ -0,0 +1,80 @@
+// Command conn-replay replays a capture (made with e.g. ctl2 -capture) of a device, and logs what its actor outputs.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/clock"
+	"nyiyui.ca/hato/sakayukari/conn"
+	"nyiyui.ca/hato/sakayukari/runtime"
+)
+
+func main() {
+	speed := flag.Float64("speed", 1, "replay this many times faster than captured")
+	velocity2 := flag.Int64("velocity2", -1, "also run Velocity2 (with this position in µm) on a breakbeam device")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatalf("usage: conn-replay [flags] capture")
+	}
+	path := flag.Arg(0)
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("open capture: %s", err)
+	}
+	records, err := conn.ReadCapture(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("read capture: %s", err)
+	}
+	c, err := conn.Replay(records, path, clock.NewScaled(*speed))
+	if err != nil {
+		log.Fatalf("replay: %s", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	b := NewBuilder()
+	connState, connActors := conn.ConnActors([]conn.Id{c.Id})
+	device := b.Add("conn "+c.Id.String(), connActors[0])
+	inputs := []ActorRef{device}
+	if *velocity2 >= 0 {
+		inputs = append(inputs, b.Add("velocity2", conn.Velocity2(device, *velocity2)))
+	}
+	logger := Actor{
+		Comment: "log",
+		InputCh: make(chan Diffuse1),
+		Inputs:  inputs,
+		Type:    ActorType{Input: true, LinearInput: true},
+	}
+	go func() {
+		for d := range logger.InputCh {
+			log.Printf("%s: %s", d.Origin, d.Value)
+		}
+	}()
+	b.Add("log", logger)
+	g, err := b.Build()
+	if err != nil {
+		log.Fatalf("build graph: %s", err)
+	}
+	i := runtime.NewInstance(g, runtime.InstanceConf{})
+	err = i.Check()
+	if err != nil {
+		log.Fatalf("check: %s", err)
+	}
+	go func() {
+		connState.HandleConn(c)
+		log.Printf("replay of %d records done", len(records))
+		stop()
+	}()
+	err = i.Diffuse(ctx)
+	if err != nil {
+		log.Fatalf("diffuse: %s", err)
+	}
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/clock"
+	"nyiyui.ca/hato/sakayukari/conn"
 	"nyiyui.ca/hato/sakayukari/ctl2"
 	"nyiyui.ca/hato/sakayukari/kujo"
 	"nyiyui.ca/hato/sakayukari/runtime"
@@ -24,6 +29,8 @@ import (
 func main() {
 	defer zap.S().Sync()
 	level := zap.LevelFlag("log-level", zap.DebugLevel, "set log level")
+	speed := flag.Float64("speed", 1, "run the simulation this many times faster than real time")
+	dotPath := flag.String("dot", "", "write the actor graph in Graphviz DOT format to this path (- for stdout) and exit")
 	flag.Parse()
 	cfg := zap.NewDevelopmentConfig()
 	cfg.Level = zap.NewAtomicLevelAt(*level)
@@ -50,27 +57,38 @@ func main() {
 		}
 	}
 
-	g := Graph{
-		Actors: []Actor{
-			Actor{
-				Comment:  "dummy",
-				OutputCh: make(chan Diffuse1),
-				Type:     ActorType{Output: true},
-			},
-		},
+	var c clock.Clock = clock.Real
+	if *speed != 1 {
+		c = clock.NewScaled(*speed)
+	}
+
+	b := NewBuilder()
+	// the devices are simulated, but the graph is made with their actors, as for real devices (see ctl2)
+	connIds := layoutConnIds(y)
+	_, connActors := conn.ConnActors(connIds)
+	conns := map[conn.Id]ActorRef{}
+	for j, id := range connIds {
+		conns[id] = b.Add(id.String(), connActors[j])
+	}
+	lineActors := map[layout.LineID]ActorRef{}
+	for _, l := range y.Lines {
+		lineActors[l.PowerConn] = conns[l.PowerConn.Conn]
+		if l.IsSwitch() {
+			lineActors[l.SwitchConn] = conns[l.SwitchConn.Conn]
+		}
 	}
 	var g2 *tal.Guide
-	var guideRef ActorRef
 	s := tal.NewSimulator("command-line")
 	{
 		var actor Actor
 		g2, actor = tal.NewGuide(tal.GuideConf{
 			DontDemo: true,
 			Layout:   y,
+			Actors:   lineActors,
 			Cars:     carsData,
+			Clock:    c,
 		})
-		g.Actors = append(g.Actors, actor)
-		guideRef = ActorRef{Index: len(g.Actors) - 1}
+		b.Add("guide", actor)
 		path := y.MustFullPathTo(
 			layout.LinePort{y.MustLookupIndex("nagase1"), layout.PortA},
 			layout.LinePort{y.MustLookupIndex("snb4"), layout.PortA},
@@ -89,36 +107,67 @@ func main() {
 		g2.PublishSnapshot()
 	}
 	s.SetGuide(g2)
-	lineActors := s.GenActorRefs(func(a Actor) ActorRef {
-		g.Actors = append(g.Actors, a)
-		return ActorRef{Index: len(g.Actors) - 1}
-	})
-	g.Actors[guideRef.Index] = g2.RemakeActor(lineActors)
 
-	g.Actors = append(g.Actors, *sakuragi.Sakuragi(sakuragi.Conf{
-		Guide:  guideRef,
-		Guide2: g2,
+	stopper, stopperActor := tal.NewEmergencyStopper(b.Ref("guide"))
+	b.Add("emergency stopper", stopperActor)
+	b.Add("sakuragi", *sakuragi.Sakuragi(sakuragi.Conf{
+		Guide:   b.Ref("guide"),
+		Guide2:  g2,
+		Stopper: stopper,
 	}))
-	sakuragiRef := ActorRef{Index: len(g.Actors) - 1}
-	_ = sakuragiRef
+	g, err := b.Build()
+	if err != nil {
+		log.Fatalf("build graph: %s", err)
+	}
+	if *dotPath != "" {
+		err = runtime.WriteDOTFile(*dotPath, g)
+		if err != nil {
+			log.Fatalf("write dot: %s", err)
+		}
+		return
+	}
 
 	zap.S().Infof("starting kujo…")
-	kujoServer := kujo.NewServer(g2)
+	kujoServer := kujo.NewServer(g2, stopper)
 	go http.ListenAndServe("0.0.0.0:8001", kujoServer.Handler())
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	zap.S().Infof("starting runtime…")
+	i := runtime.NewInstance(g, runtime.InstanceConf{
+		Clock: c,
+		EmergencyStop: func(hung ActorRef) {
+			zap.S().Errorf("emergency stop: actor %s hung", hung)
+			stopper.Send(ctx, tal.GuideEmergencyStop{})
+		},
+	})
+	err = i.Check()
+	if err != nil {
+		log.Fatalf("check: %s", err)
+	}
+	kujoServer.Handle("/debug/graph.dot", i.DOTHandler())
+	kujoServer.Handle("/metrics", i.MetricsHandler())
 	go func() {
-		zap.S().Infof("starting runtime…")
-		i := runtime.NewInstance(&g)
-		err = i.Check()
-		if err != nil {
-			log.Fatalf("check: %s", err)
-		}
-		err = i.Diffuse()
+		err := i.Diffuse(ctx)
 		if err != nil {
 			log.Fatalf("diffuse: %s", err)
 		}
+		zap.S().Infof("runtime shut down")
+		zap.S().Sync()
+		os.Exit(0)
 	}()
 
+	// swap the devices' actors for simulated ones
+	s.GenActorRefs(func(id conn.Id, a Actor) ActorRef {
+		ref := conns[id]
+		err := i.ReplaceActor(ref, a)
+		if err != nil {
+			log.Fatalf("replace %s: %s", id, err)
+		}
+		// the device's actor is left running (without a device, it discards its inputs), as a diffuse may still be being sent to it
+		return ref
+	})
+
 	go func() {
 		time.Sleep(1 * time.Second)
 		ctl2.WaypointControl2(g2, kujoServer)
@@ -126,7 +175,7 @@ func main() {
 
 	go func() {
 		zap.S().Infof("starting simulation…")
-		s.Run()
+		s.Run(ctx)
 	}()
 
 	zap.S().Infof("starting senri…")
@@ -135,3 +184,23 @@ func main() {
 		zap.S().Fatalf("senri: %s", err)
 	}
 }
+
+// layoutConnIds returns the ids of all devices of lines in y.
+func layoutConnIds(y *layout.Layout) []conn.Id {
+	ids := []conn.Id{}
+	seen := map[conn.Id]bool{}
+	add := func(id conn.Id) {
+		if id == (conn.Id{}) || seen[id] {
+			return
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	for _, l := range y.Lines {
+		add(l.PowerConn.Conn)
+		if l.IsSwitch() {
+			add(l.SwitchConn.Conn)
+		}
+	}
+	return ids
+}
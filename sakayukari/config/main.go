@@ -1,21 +1,63 @@
+// Package config describes a layout and the devices controlling it in a file, so controllers (e.g. ctl2) can be wired up without hardcoding them.
 package config
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	. "nyiyui.ca/hato/sakayukari"
 	"nyiyui.ca/hato/sakayukari/conn"
+	"nyiyui.ca/hato/sakayukari/tal"
 	"nyiyui.ca/hato/sakayukari/tal/cars"
+	"nyiyui.ca/hato/sakayukari/tal/layout"
 )
 
 type Config struct {
-	Lines []Line    `json:"lines"`
-	RFIDs []RFID    `json:"rfids"`
-	Cars  cars.Data `json:"cars"`
+	// Layout is the name of a layout in layout.Hardcoded.
+	Layout  string    `json:"layout"`
+	Devices []Device  `json:"devices"`
+	Lines   []Line    `json:"lines"`
+	RFIDs   []RFID    `json:"rfids"`
+	Cars    cars.Data `json:"cars"`
+	// CarsPath is a file with Cars (e.g. cars.json made from cars.toml), relative to the config file.
+	// It is used instead of Cars if set.
+	CarsPath string  `json:"cars-path"`
+	Trains   []Train `json:"trains"`
+}
+
+type Device struct {
+	ID conn.Id `json:"id"`
+	// TCP is the address (host:port) of the device if it is reachable over TCP (see conn.State.SetNetworkDevices).
+	TCP string `json:"tcp"`
+	// Baud is the baud rate of the device if it is connected over serial, and is not conn.DefaultBaud (e.g. 115200 for rfid and line2 firmware).
+	Baud int `json:"baud"`
+	// Thresholds are current thresholds in mA of lines of a line device (see conn.CurrentConf).
+	Thresholds       map[string]int `json:"thresholds"`
+	DefaultThreshold int            `json:"default-threshold"`
 }
 
+// Line sets the devices of a line in the layout, instead of the ones hardcoded in the layout.
 type Line struct {
+	// Name is the comment of the line in the layout.
+	Name string `json:"name"`
+	// DeviceLine is the line of the device powering the line.
+	DeviceLine
+	// Switch is the line of the device switching the line, if the line is a switch.
+	Switch *DeviceLine `json:"switch"`
+}
+
+type DeviceLine struct {
 	ConnID  conn.Id `json:"conn-id"`
 	SubLine string  `json:"sub-line"`
 }
 
+func (s DeviceLine) lineID() layout.LineID {
+	return layout.LineID{Conn: s.ConnID, Line: s.SubLine}
+}
+
 type RFID struct {
 	ConnID   conn.Id  `json:"conn-id"`
 	Position Position `json:"position"`
@@ -26,3 +68,222 @@ type Position struct {
 	Precise int64  `json:"precise"`
 	Port    string `json:"port"`
 }
+
+// Train is a train on the layout at startup.
+type Train struct {
+	Form uuid.UUID `json:"form"`
+	// Orient is A or B (see tal.FormOrient).
+	Orient string `json:"orient"`
+	// From and To are the ends of the train's path; the train starts at From.
+	From Port `json:"from"`
+	To   Port `json:"to"`
+}
+
+type Port struct {
+	Line string `json:"line"`
+	Port string `json:"port"`
+}
+
+// Load reads a config from a JSON file.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if c.CarsPath != "" {
+		carsPath := filepath.Join(filepath.Dir(path), c.CarsPath)
+		data, err := os.ReadFile(carsPath)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &c.Cars)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", carsPath, err)
+		}
+	}
+	return c, nil
+}
+
+// ConnIds returns the ids of all devices.
+func (c *Config) ConnIds() []conn.Id {
+	ids := make([]conn.Id, len(c.Devices))
+	for i, d := range c.Devices {
+		ids[i] = d.ID
+	}
+	return ids
+}
+
+// SetupConns sets TCP addresses, baud rates and current thresholds of devices to s (which should be from conn.ConnActors(c.ConnIds())).
+func (c *Config) SetupConns(s *conn.State) {
+	addrs := []string{}
+	for _, d := range c.Devices {
+		if d.TCP != "" {
+			addrs = append(addrs, d.TCP)
+		}
+		if d.Baud != 0 {
+			s.SetBaud(d.ID, d.Baud)
+		}
+		if d.Thresholds != nil || d.DefaultThreshold != 0 {
+			s.SetCurrentConf(d.ID, conn.CurrentConf{Thresholds: d.Thresholds, Default: d.DefaultThreshold})
+		}
+	}
+	if len(addrs) > 0 {
+		s.SetNetworkDevices(addrs)
+	}
+}
+
+// LoadLayout returns the layout named by c.Layout, with the devices of lines set by c.Lines.
+func (c *Config) LoadLayout() (*layout.Layout, error) {
+	init, ok := layout.Hardcoded[c.Layout]
+	if !ok {
+		return nil, fmt.Errorf("unknown layout %q", c.Layout)
+	}
+	y, err := init()
+	if err != nil {
+		return nil, fmt.Errorf("layout %s: %w", c.Layout, err)
+	}
+	for _, l := range c.Lines {
+		li, err := lookup(y, l.Name)
+		if err != nil {
+			return nil, err
+		}
+		y.Lines[li].PowerConn = l.lineID()
+		if l.Switch != nil {
+			if !y.Lines[li].IsSwitch() {
+				return nil, fmt.Errorf("line %s: not a switch", l.Name)
+			}
+			y.Lines[li].SwitchConn = l.Switch.lineID()
+		}
+	}
+	return y, nil
+}
+
+// GuideActors returns actors for all lines of y (for tal.GuideConf.Actors), given the actors of devices.
+func (c *Config) GuideActors(y *layout.Layout, conns map[conn.Id]ActorRef) (map[layout.LineID]ActorRef, error) {
+	actors := map[layout.LineID]ActorRef{}
+	add := func(l layout.Line, id layout.LineID) error {
+		ref, ok := conns[id.Conn]
+		if !ok {
+			return fmt.Errorf("line %s: device %s not in devices", l.Comment, id.Conn)
+		}
+		actors[id] = ref
+		return nil
+	}
+	for _, l := range y.Lines {
+		err := add(l, l.PowerConn)
+		if err != nil {
+			return nil, err
+		}
+		if l.IsSwitch() {
+			err = add(l, l.SwitchConn)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return actors, nil
+}
+
+// ModelRFIDs returns RFID readers on y (for tal.ModelConf.RFIDs), given the actors of devices.
+func (c *Config) ModelRFIDs(y *layout.Layout, conns map[conn.Id]ActorRef) ([]tal.RFID, error) {
+	rfids := make([]tal.RFID, 0, len(c.RFIDs))
+	for _, r := range c.RFIDs {
+		ref, ok := conns[r.ConnID]
+		if !ok {
+			return nil, fmt.Errorf("rfid %s not in devices", r.ConnID)
+		}
+		li, err := lookup(y, r.Position.Line)
+		if err != nil {
+			return nil, fmt.Errorf("rfid %s: %w", r.ConnID, err)
+		}
+		pi, err := parsePort(r.Position.Port)
+		if err != nil {
+			return nil, fmt.Errorf("rfid %s: %w", r.ConnID, err)
+		}
+		if r.Position.Precise < 0 {
+			return nil, fmt.Errorf("rfid %s: negative position", r.ConnID)
+		}
+		rfids = append(rfids, tal.RFID{
+			Ref:      ref,
+			Position: layout.Position{LineI: li, Precise: uint32(r.Position.Precise), Port: pi},
+		})
+	}
+	return rfids, nil
+}
+
+// LoadTrains returns the trains on y at startup (for tal.Guide.InternalSetTrains).
+func (c *Config) LoadTrains(y *layout.Layout) ([]tal.Train, error) {
+	trains := make([]tal.Train, 0, len(c.Trains))
+	for ti, t := range c.Trains {
+		if _, ok := c.Cars.Forms[t.Form]; !ok {
+			return nil, fmt.Errorf("train %d: form %s not in cars", ti, t.Form)
+		}
+		var orient tal.FormOrient
+		switch t.Orient {
+		case "A":
+			orient = tal.FormOrientA
+		case "B":
+			orient = tal.FormOrientB
+		default:
+			return nil, fmt.Errorf("train %d: orient must be A or B, not %q", ti, t.Orient)
+		}
+		from, err := t.From.linePort(y)
+		if err != nil {
+			return nil, fmt.Errorf("train %d: from: %w", ti, err)
+		}
+		to, err := t.To.linePort(y)
+		if err != nil {
+			return nil, fmt.Errorf("train %d: to: %w", ti, err)
+		}
+		path, err := y.FullPathTo(from, to, layout.FullPathToOption{})
+		if err != nil {
+			return nil, fmt.Errorf("train %d: path: %w", ti, err)
+		}
+		trains = append(trains, tal.Train{
+			State:  tal.TrainStateNextAvail,
+			FormI:  t.Form,
+			Orient: orient,
+			Path:   &path,
+		})
+	}
+	return trains, nil
+}
+
+func (p Port) linePort(y *layout.Layout) (layout.LinePort, error) {
+	li, err := lookup(y, p.Line)
+	if err != nil {
+		return layout.LinePort{}, err
+	}
+	pi, err := parsePort(p.Port)
+	if err != nil {
+		return layout.LinePort{}, err
+	}
+	return layout.LinePort{LineI: li, PortI: pi}, nil
+}
+
+func lookup(y *layout.Layout, name string) (layout.LineI, error) {
+	for li, l := range y.Lines {
+		if l.Comment == name {
+			return layout.LineI(li), nil
+		}
+	}
+	return 0, fmt.Errorf("no line %q in layout", name)
+}
+
+func parsePort(port string) (layout.PortI, error) {
+	switch port {
+	case "A":
+		return layout.PortA, nil
+	case "B":
+		return layout.PortB, nil
+	case "C":
+		return layout.PortC, nil
+	default:
+		return 0, fmt.Errorf("port must be A, B, or C, not %q", port)
+	}
+}
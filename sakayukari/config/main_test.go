@@ -0,0 +1,76 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/conn"
+	"nyiyui.ca/hato/sakayukari/tal/layout"
+)
+
+func TestLoad(t *testing.T) {
+	c, err := Load("../config.json")
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	y, err := c.LoadLayout()
+	if err != nil {
+		t.Fatalf("layout: %s", err)
+	}
+	peach := conn.Id{Type: "soyuu-kdss", Variant: "v4", Instance: "peach"}
+	if diff := cmp.Diff([]conn.Id{peach}, c.ConnIds()); diff != "" {
+		t.Fatalf("ids (-want +got):\n%s", diff)
+	}
+	ref := ActorRef{Index: 1}
+	actors, err := c.GuideActors(y, map[conn.Id]ActorRef{peach: ref})
+	if err != nil {
+		t.Fatalf("guide actors: %s", err)
+	}
+	for _, l := range y.Lines {
+		if actors[l.PowerConn] != ref {
+			t.Fatalf("line %s: no actor for %s", l.Comment, l.PowerConn)
+		}
+	}
+	_, err = c.GuideActors(y, map[conn.Id]ActorRef{})
+	if err == nil {
+		t.Fatal("missing device not reported")
+	}
+	trains, err := c.LoadTrains(y)
+	if err != nil {
+		t.Fatalf("trains: %s", err)
+	}
+	want := y.MustFullPathTo(
+		layout.LinePort{LineI: y.MustLookupIndex("nagase1"), PortI: layout.PortA},
+		layout.LinePort{LineI: y.MustLookupIndex("snb4"), PortI: layout.PortA},
+	)
+	if len(trains) != 2 {
+		t.Fatalf("%d trains", len(trains))
+	}
+	if diff := cmp.Diff(want, *trains[0].Path); diff != "" {
+		t.Fatalf("path (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadLayoutLines(t *testing.T) {
+	other := conn.Id{Type: "soyuu-kdss", Variant: "v4", Instance: "other"}
+	c := &Config{
+		Layout: "testbench6c",
+		Lines: []Line{
+			{Name: "snb4", DeviceLine: DeviceLine{ConnID: other, SubLine: "A"}, Switch: &DeviceLine{ConnID: other, SubLine: "B"}},
+		},
+	}
+	y, err := c.LoadLayout()
+	if err != nil {
+		t.Fatalf("layout: %s", err)
+	}
+	l := y.Lines[y.MustLookupIndex("snb4")]
+	if l.PowerConn != (layout.LineID{Conn: other, Line: "A"}) || l.SwitchConn != (layout.LineID{Conn: other, Line: "B"}) {
+		t.Fatalf("got %s %s", l.PowerConn, l.SwitchConn)
+	}
+	c.Lines[0].Name = "nonexistent"
+	_, err = c.LoadLayout()
+	if err == nil {
+		t.Fatal("nonexistent line not reported")
+	}
+}
@@ -5,19 +5,13 @@ import (
 	"fmt"
 	"log"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
 	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/conn/hlcp"
 )
 
-type sensor struct {
-	ID rune
-	// Position of the sensor in µm from an arbitrary point of the sensor
-	Position int64
-}
-
 type handlerBreakbeam struct{}
 
 func (_ handlerBreakbeam) String() string {
@@ -31,57 +25,43 @@ func (_ handlerBreakbeam) HandleConn(a Actor, c *Conn) {
 		log.Printf("%s: J: write line: %s", c.Path, err)
 		return
 	}
-	var sensors []sensor
-	{
-		jRaw, err := reader.ReadString('\n')
-		if err != nil {
-			log.Printf("%s: J: read line: %s", c.Path, err)
-			return
-		}
-		log.Printf("breakbeam: J: %s", jRaw)
-		parts := strings.SplitN(jRaw, ";", 2)
-		sensorRaws := strings.Split(parts[1], " ")
-		sensors = make([]sensor, 0, len(sensorRaws))
-		for i, sensorRaw := range sensorRaws {
-			// NOTE: assume JAP248000 form (A = sensor id, 248000 = position in µm)
-			pos, err := strconv.ParseInt(strings.TrimSpace(sensorRaw[3:]), 10, 64)
-			if err != nil {
-				log.Printf("%s: J: parse %d: %s", c.Path, i, err)
-				return
-			}
-			sensors = append(sensors, sensor{
-				ID:       rune(sensorRaw[1]),
-				Position: pos,
-			})
-		}
+	jRaw, err := reader.ReadString('\n')
+	if err != nil {
+		log.Printf("%s: J: read line: %s", c.Path, err)
+		return
+	}
+	log.Printf("breakbeam: J: %s", jRaw)
+	j, err := hlcp.DecodeId(strings.TrimRight(jRaw, "\r\n"))
+	if err != nil {
+		log.Printf("%s: J: %s", c.Path, err)
+		return
 	}
 
 	for {
 		lineRaw, err := reader.ReadString('\n')
 		if err != nil {
 			log.Printf("%s: read line: %s", c.Path, err)
-			continue
+			return
 		}
 		if !strings.HasPrefix(lineRaw, " D") {
 			continue
 		}
-		line := lineRaw[2:]
-		values, monotonic, err := parse(line)
+		seen, err := hlcp.DecodeSeen(strings.TrimRight(lineRaw, "\r\n"))
 		if err != nil {
 			log.Printf("handlerBreakbeam: %s", err)
 			continue
 		}
-		v := ValSeen{Monotonic: monotonic, Sensors: make([]ValSeenSensor, 0, len(values))}
-		for sensor, value := range values {
+		v := ValSeen{Monotonic: seen.Monotonic, Sensors: make([]ValSeenSensor, 0, len(seen.Values))}
+		for _, value := range seen.Values {
 			var pos int64 = -1
-			for _, s := range sensors {
-				if s.ID == rune(sensor[0]) {
+			for _, s := range j.Sensors {
+				if s.Name == value.Name {
 					pos = s.Position
 				}
 			}
 			v.Sensors = append(v.Sensors, ValSeenSensor{
-				Name:     sensor,
-				Seen:     value,
+				Name:     value.Name,
+				Seen:     value.Value,
 				Position: pos,
 			})
 		}
@@ -140,29 +120,6 @@ func (_ handlerBreakbeam) NewBlankActor() Actor {
 	}
 }
 
-func parse(line string) (values map[string]bool, monotonic int64, err error) {
-	values = map[string]bool{}
-	for i := 0; i < len(line); i++ {
-		switch {
-		case line[i] == 'T':
-			j := strings.IndexFunc(line[i+1:], func(r rune) bool { return r >= 'A' && r <= 'Z' })
-			if j == -1 {
-				j = len(line) - i
-			}
-			monotonic, err = strconv.ParseInt(strings.TrimSpace(line[i+1:i+j]), 10, 64)
-			if err != nil {
-				err = fmt.Errorf("parse: T: %s", err)
-				return
-			}
-			i += j
-		case line[i] >= 'A' && line[i] <= 'Z':
-			values[string(line[i])] = line[i+1] == '1'
-			i++
-		}
-	}
-	return
-}
-
 type velocity2Single struct {
 	Monotonic int64
 	PointA    bool
@@ -238,7 +195,11 @@ func Velocity2(breakbeam ActorRef, position int64) Actor {
 				panic(fmt.Sprintf("unknown origin %s", d.Origin))
 			}
 			now := time.Now()
-			v := d.Value.(ValSeen)
+			v, ok := d.Value.(ValSeen)
+			if !ok {
+				// e.g. ValConnState
+				continue
+			}
 			if sps == nil || s.Histories == nil {
 				sps = make([]sensorPoint, 0, len(v.Sensors))
 				for _, sensor := range v.Sensors {
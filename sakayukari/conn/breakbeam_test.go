@@ -3,7 +3,11 @@ package conn
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"testing"
+
+	"nyiyui.ca/hato/sakayukari/conn/emulator"
+	"nyiyui.ca/hato/sakayukari/conn/hlcp"
 )
 
 type testCase struct {
@@ -18,10 +22,15 @@ func TestParse(t *testing.T) {
 	}
 	for i, tc := range cases {
 		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
-			values, monotonic, err := parse(tc.Line)
+			seen, err := hlcp.DecodeSeen(" D" + tc.Line)
 			if err != nil {
 				t.Fatal(err)
 			}
+			values := map[string]bool{}
+			for _, v := range seen.Values {
+				values[v.Name] = v.Value
+			}
+			monotonic := seen.Monotonic
 			if monotonic != tc.Monotonic {
 				t.Fatal("monotonic mismatch")
 			}
@@ -31,3 +40,28 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlerBreakbeam(t *testing.T) {
+	d := emulator.New(emulator.Conf{
+		Id:      "soyuu-breakbeam/itsybitsy0/0",
+		Sensors: []emulator.Sensor{{ID: 'A', Position: 0}, {ID: 'B', Position: 248000}},
+		OnIdentify: func(d *emulator.Device, kind byte) {
+			if kind == 'J' {
+				d.ReportSeen(map[string]bool{"A": true, "B": false})
+			}
+		},
+	})
+	a := handlerBreakbeam{}.NewBlankActor()
+	c := &Conn{Id: ParseId("soyuu-breakbeam/itsybitsy0/0"), Path: "/dev/test0", F: d.Pipe()}
+	go handlerBreakbeam{}.HandleConn(a, c)
+
+	v := (<-a.OutputCh).Value.(ValSeen)
+	sort.Slice(v.Sensors, func(i, j int) bool { return v.Sensors[i].Name < v.Sensors[j].Name })
+	want := []ValSeenSensor{
+		{Name: "A", Seen: true, Position: 0},
+		{Name: "B", Seen: false, Position: 248000},
+	}
+	if !reflect.DeepEqual(v.Sensors, want) {
+		t.Fatalf("got %#v, want %#v", v.Sensors, want)
+	}
+}
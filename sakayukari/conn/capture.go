@@ -0,0 +1,161 @@
+package conn
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nyiyui.ca/hato/sakayukari/conn/hlcp"
+)
+
+// A capture has all bytes read from and written to a device, one Record per line:
+//
+//	2023-06-01T08:18:53.123456789+09:00 r " DA1B1C0T21572396\r\n"
+//
+// The first record is a RecordIdentify, so the device can be replayed (see Replay).
+
+const (
+	// RecordIdentify has the device's id and capabilities, encoded as a reply to Identify.
+	RecordIdentify byte = 'I'
+	// RecordRead has bytes read from the device.
+	RecordRead byte = 'r'
+	// RecordWrite has bytes written to the device.
+	RecordWrite byte = 'w'
+)
+
+type Record struct {
+	Time time.Time
+	Kind byte
+	Data []byte
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%s %c %s", r.Time.Format(time.RFC3339Nano), r.Kind, strconv.Quote(string(r.Data)))
+}
+
+// ParseRecord parses a line of a capture (without the newline).
+func ParseRecord(line string) (Record, error) {
+	rawTime, rest, ok := strings.Cut(line, " ")
+	if !ok || len(rest) < 2 || rest[1] != ' ' {
+		return Record{}, errors.New("expected time, kind and data")
+	}
+	t, err := time.Parse(time.RFC3339Nano, rawTime)
+	if err != nil {
+		return Record{}, fmt.Errorf("time: %w", err)
+	}
+	kind := rest[0]
+	switch kind {
+	case RecordIdentify, RecordRead, RecordWrite:
+	default:
+		return Record{}, fmt.Errorf("unknown kind %q", kind)
+	}
+	data, err := strconv.Unquote(rest[2:])
+	if err != nil {
+		return Record{}, fmt.Errorf("data: %w", err)
+	}
+	return Record{Time: t, Kind: kind, Data: []byte(data)}, nil
+}
+
+// ReadCapture reads all records of a capture.
+func ReadCapture(r io.Reader) ([]Record, error) {
+	records := []Record{}
+	scanner := bufio.NewScanner(r)
+	// a record of a whole read buffer can be longer than bufio.MaxScanTokenSize when quoted
+	scanner.Buffer(nil, 1<<20)
+	for i := 1; scanner.Scan(); i++ {
+		rec, err := ParseRecord(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// SetCaptureDir makes connections (made after this) capture their bytes into a new file in dir.
+// Capturing is disabled if dir is empty.
+func (s *State) SetCaptureDir(dir string) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	s.captureDir = dir
+}
+
+// capturer writes records to a capture file.
+type capturer struct {
+	lock sync.Mutex
+	f    *os.File
+	// failed is true after a write to f failed, so the error is only logged once.
+	failed bool
+}
+
+// openCapture makes a capture file for c in dir, and records c's id.
+func openCapture(dir string, c *Conn) (*capturer, error) {
+	id, err := hlcp.Encode(hlcp.Id{Id: c.Id.String(), Capabilities: c.Capabilities})
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s_%s_%s-%s.capture", c.Id.Type, c.Id.Variant, c.Id.Instance, time.Now().Format("20060102T150405.000"))
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%s: capturing to %s", c.Path, f.Name())
+	cp := &capturer{f: f}
+	cp.record(RecordIdentify, []byte(id))
+	return cp, nil
+}
+
+func (cp *capturer) record(kind byte, data []byte) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	_, err := fmt.Fprintln(cp.f, Record{Time: time.Now(), Kind: kind, Data: data})
+	if err != nil && !cp.failed {
+		cp.failed = true
+		log.Printf("capture %s: %s", cp.f.Name(), err)
+	}
+}
+
+func (cp *capturer) Close() error {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	return cp.f.Close()
+}
+
+// captureConn records everything read from and written to f.
+type captureConn struct {
+	f  io.ReadWriter
+	cp *capturer
+}
+
+func (c *captureConn) Read(p []byte) (n int, err error) {
+	n, err = c.f.Read(p)
+	if n > 0 {
+		c.cp.record(RecordRead, p[:n])
+	}
+	return
+}
+
+func (c *captureConn) Write(p []byte) (n int, err error) {
+	n, err = c.f.Write(p)
+	if n > 0 {
+		c.cp.record(RecordWrite, p[:n])
+	}
+	return
+}
+
+func (c *captureConn) Close() error {
+	if closer, ok := c.f.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *captureConn) Flush() error { return flush(c.f) }
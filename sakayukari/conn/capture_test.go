@@ -0,0 +1,88 @@
+package conn
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/conn/emulator"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	id := ParseId("soyuu-breakbeam/itsybitsy0/0")
+	d := emulator.New(emulator.Conf{
+		Id:      id.String(),
+		Sensors: []emulator.Sensor{{ID: 'A', Position: 0}, {ID: 'B', Position: 248000}},
+		OnIdentify: func(d *emulator.Device, kind byte) {
+			if kind == 'J' {
+				d.ReportSeen(map[string]bool{"A": true, "B": false})
+			}
+		},
+	})
+	want := []ValSeenSensor{
+		{Name: "A", Seen: true, Position: 0},
+		{Name: "B", Seen: false, Position: 248000},
+	}
+	seen := func(a Actor) []ValSeenSensor {
+		v := (<-a.OutputCh).Value.(ValSeen)
+		sort.Slice(v.Sensors, func(i, j int) bool { return v.Sensors[i].Name < v.Sensors[j].Name })
+		return v.Sensors
+	}
+
+	dir := t.TempDir()
+	s, as := ConnActors([]Id{id})
+	s.SetCaptureDir(dir)
+	go s.handleConn(&Conn{Id: id, Path: "/dev/test0", F: d.Pipe()})
+	<-as[0].OutputCh // up
+	if got := seen(as[0]); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+	d.Disconnect()
+	<-as[0].OutputCh // down
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.capture"))
+	if err != nil || len(names) != 1 {
+		t.Fatalf("captures: %v %s", names, err)
+	}
+	f, err := os.Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := ReadCapture(f)
+	if err != nil {
+		t.Fatalf("read capture: %s", err)
+	}
+	kinds := []byte{}
+	for _, rec := range records {
+		kinds = append(kinds, rec.Kind)
+	}
+	// identify, J, J reply, and the seen report (possibly in the same read as the J reply)
+	if len(kinds) < 3 || kinds[0] != RecordIdentify || kinds[1] != RecordWrite || string(records[1].Data) != "J\n" {
+		t.Fatalf("records: %s", records)
+	}
+
+	c, err := Replay(records, names[0], nil)
+	if err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+	if c.Id != id {
+		t.Fatalf("replayed id %s", c.Id)
+	}
+	s2, as2 := ConnActors([]Id{id})
+	go s2.HandleConn(c)
+	if diff := cmp.Diff(ValConnState{Id: id, Path: names[0], Up: true}, (<-as2[0].OutputCh).Value); diff != "" {
+		t.Fatalf("up (-want +got):\n%s", diff)
+	}
+	if got := seen(as2[0]); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed got %#v, want %#v", got, want)
+	}
+	// the replay ends after the last record
+	if diff := cmp.Diff(ValConnState{Id: id, Path: names[0], Up: false}, (<-as2[0].OutputCh).Value); diff != "" {
+		t.Fatalf("down (-want +got):\n%s", diff)
+	}
+}
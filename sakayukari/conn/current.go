@@ -0,0 +1,29 @@
+package conn
+
+// DefaultThreshold is the threshold in mA of lines without one, which is about what the kdss firmware used before it reported milliamps.
+const DefaultThreshold = 20
+
+// CurrentConf configures how the currents reported by a line device are turned into Flow.
+type CurrentConf struct {
+	// Thresholds are the currents in mA above which lines are occupied.
+	Thresholds map[LineName]int
+	// Default is the threshold of lines not in Thresholds. If 0, DefaultThreshold is used.
+	Default int
+}
+
+func (c CurrentConf) threshold(line LineName) int {
+	if t, ok := c.Thresholds[line]; ok {
+		return t
+	}
+	if c.Default == 0 {
+		return DefaultThreshold
+	}
+	return c.Default
+}
+
+// SetCurrentConf sets how the currents reported by the device id are turned into Flow, from the next time it is connected.
+func (s *State) SetCurrentConf(id Id, conf CurrentConf) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	s.currents[id] = conf
+}
@@ -0,0 +1,441 @@
+// Package emulator emulates the device side of the protocol spoken by soyuu boards (kdss, line, breakbeam, rfid), so conn can be tested without hardware.
+//
+// This package does not import conn, so that tests in conn can use it.
+package emulator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nyiyui.ca/hato/sakayukari/clock"
+	"nyiyui.ca/hato/sakayukari/conn/hlcp"
+)
+
+// Sensor is listed in reply to J.
+type Sensor struct {
+	ID byte
+	// Position in µm.
+	Position int64
+}
+
+// Command is a C (change) or S (switch) command received.
+type Command struct {
+	// Kind is 'C' or 'S'.
+	Kind      byte
+	Line      string
+	Direction bool
+	Brake     bool
+	Power     uint8
+	// Duration and BrakeAfter are only for S.
+	Duration   time.Duration
+	BrakeAfter bool
+	// Seq is the sequence number to acknowledge, or 0 if none.
+	Seq int
+}
+
+// LineState is the output of a line (channel).
+type LineState struct {
+	Direction bool
+	Brake     bool
+	Power     uint8
+}
+
+type Conf struct {
+	// Id is replied to I, e.g. "soyuu-kdss/v4/test".
+	Id string
+	// Sensors are listed in reply to J.
+	Sensors []Sensor
+	// Clock is used for times in reports and for S durations. If nil, clock.Real is used.
+	Clock clock.Clock
+	// OnIdentify is called after replying to I or J (kind is 'I' or 'J'), e.g. to start reporting once the host is ready.
+	OnIdentify func(d *Device, kind byte)
+	// OnCommand is called after a C or S command is applied, e.g. to report currents.
+	// It is called with no locks held, so it can call methods of d.
+	OnCommand func(d *Device, cmd Command)
+	// Ack makes the device advertise hlcp.CapAck, and acknowledge commands with sequence numbers.
+	Ack bool
+	// Lose, if not nil, is called for each C or S command received; if it returns true, the command is ignored, as if it was lost in transit.
+	Lose func(cmd Command) bool
+	// Reject, if not nil, is called for each C or S command not lost; if it returns a reason, the command is not applied, and is rejected with hlcp.Nack (if it has a sequence number).
+	Reject func(cmd Command) string
+	// Heartbeat makes the device advertise hlcp.CapHeartbeat, reply to pings, and turn off all lines when pings stop.
+	Heartbeat bool
+	// LosePing, if not nil, is called for each ping received; if it returns true, the ping is ignored, as if it was lost in transit.
+	LosePing func() bool
+}
+
+// Device is an emulated device. Its state is kept across connections, like a real device that is unplugged without resetting.
+type Device struct {
+	conf  Conf
+	clock clock.Clock
+	start time.Time
+
+	lock  sync.Mutex
+	lines map[string]LineState
+	// stops stop lines after the duration of an S command.
+	stops map[string]*stop
+	// failsafe turns off all lines if pings stop.
+	failsafe *stop
+	// w is the current connection, or nil.
+	w     io.Writer
+	close func() error
+	// writeLock serializes writes, so lines are not interleaved.
+	writeLock sync.Mutex
+}
+
+type stop struct {
+	timer    *clock.Timer
+	canceled chan struct{}
+}
+
+func New(conf Conf) *Device {
+	d := &Device{
+		conf:  conf,
+		clock: clock.Or(conf.Clock),
+		lines: map[string]LineState{},
+		stops: map[string]*stop{},
+	}
+	d.start = d.clock.Now()
+	return d
+}
+
+// Pipe serves d on an in-process connection, and returns the host side.
+// Closing the host side disconnects d, and vice versa (see Disconnect).
+func (d *Device) Pipe() net.Conn {
+	host, device := net.Pipe()
+	d.connect(device)
+	go d.serve(device)
+	return host
+}
+
+// Serve talks to the host over rw until reading from rw fails.
+// Only one connection is served at a time; Serve disconnects the previous connection.
+func (d *Device) Serve(rw io.ReadWriter) error {
+	d.connect(rw)
+	return d.serve(rw)
+}
+
+func (d *Device) connect(rw io.ReadWriter) {
+	d.Disconnect()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.w = rw
+	d.close = func() error { return nil }
+	if c, ok := rw.(io.Closer); ok {
+		d.close = c.Close
+	}
+}
+
+func (d *Device) serve(rw io.ReadWriter) error {
+	defer func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if d.w == rw {
+			d.w = nil
+			d.close = nil
+		}
+	}()
+	r := bufio.NewReader(rw)
+	for {
+		err := d.handle(r)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Disconnect closes the current connection (if any), like unplugging the device.
+func (d *Device) Disconnect() {
+	d.lock.Lock()
+	closeConn := d.close
+	d.w = nil
+	d.close = nil
+	d.lock.Unlock()
+	if closeConn != nil {
+		closeConn()
+	}
+}
+
+// millis returns the time since d was made in ms, like Arduino's millis().
+func (d *Device) millis() int64 {
+	return d.clock.Since(d.start).Milliseconds()
+}
+
+// handle reads and handles a single command. Like the firmware, the first byte of a command determines how many bytes follow.
+func (d *Device) handle(r *bufio.Reader) error {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case 'I', 'J':
+		err = d.identify(r, kind)
+	case 'C', 'S':
+		n := len("AAN000\n")
+		if kind == 'S' {
+			n = len("AAN000T00000N\n")
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return err
+		}
+		if buf[n-1] == '#' {
+			rest := make([]byte, len("0000\n"))
+			_, err = io.ReadFull(r, rest)
+			if err != nil {
+				return err
+			}
+			buf = append(buf, rest...)
+		}
+		cmd, err := parseCommand(kind, string(buf))
+		if err != nil {
+			d.send(hlcp.DeviceError{Message: err.Error()})
+			return nil
+		}
+		d.command(cmd)
+	case 'P':
+		if !d.conf.Heartbeat {
+			// like firmware without heartbeats
+			d.send(hlcp.DeviceError{Message: fmt.Sprintf("unknown kind %d", kind)})
+			break
+		}
+		buf := make([]byte, len("00000\n"))
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return err
+		}
+		m, err := hlcp.DecodeRequest("P" + strings.TrimSuffix(string(buf), "\n"))
+		if err != nil {
+			d.send(hlcp.DeviceError{Message: err.Error()})
+			return nil
+		}
+		d.ping(m.(hlcp.Ping))
+	case 'f':
+		_, err = io.ReadFull(r, make([]byte, 3))
+	case 'L', 'M':
+		_, err = io.ReadFull(r, make([]byte, 5))
+	case 'G', 'g', '\n', '\r':
+	default:
+		d.send(hlcp.DeviceError{Message: fmt.Sprintf("unknown kind %d", kind)})
+	}
+	return err
+}
+
+// command applies (or loses or rejects) cmd, and acknowledges it.
+func (d *Device) command(cmd Command) {
+	if d.conf.Lose != nil && d.conf.Lose(cmd) {
+		return
+	}
+	if d.conf.Reject != nil {
+		if reason := d.conf.Reject(cmd); reason != "" {
+			if cmd.Seq != 0 {
+				d.send(hlcp.Nack{Seq: cmd.Seq, Reason: reason})
+			} else {
+				d.send(hlcp.DeviceError{Message: reason})
+			}
+			return
+		}
+	}
+	d.apply(cmd)
+	if cmd.Seq != 0 {
+		d.send(hlcp.Ack{Seq: cmd.Seq})
+	} else {
+		d.Println(" Ook")
+	}
+	if d.conf.OnCommand != nil {
+		d.conf.OnCommand(d, cmd)
+	}
+}
+
+// ping replies to a ping, and (re)starts the failsafe.
+func (d *Device) ping(m hlcp.Ping) {
+	if d.conf.LosePing != nil && d.conf.LosePing() {
+		return
+	}
+	d.lock.Lock()
+	if d.failsafe != nil {
+		d.failsafe.timer.Stop()
+		close(d.failsafe.canceled)
+	}
+	st := &stop{timer: d.clock.NewTimer(m.Timeout), canceled: make(chan struct{})}
+	d.failsafe = st
+	d.lock.Unlock()
+	go func() {
+		select {
+		case <-st.timer.C:
+		case <-st.canceled:
+			return
+		}
+		d.lock.Lock()
+		if d.failsafe != st {
+			d.lock.Unlock()
+			return
+		}
+		d.failsafe = nil
+		for line, ls := range d.lines {
+			d.lines[line] = LineState{Direction: ls.Direction}
+		}
+		for line, st := range d.stops {
+			st.timer.Stop()
+			close(st.canceled)
+			delete(d.stops, line)
+		}
+		d.lock.Unlock()
+		d.send(hlcp.DeviceError{Message: "failsafe: no heartbeat"})
+	}()
+	d.send(hlcp.Pong{Monotonic: d.millis()})
+}
+
+// identify replies to I (identification) or J (sensor listing).
+func (d *Device) identify(r *bufio.Reader, kind byte) error {
+	_, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	m := hlcp.Id{Id: d.conf.Id}
+	if d.conf.Ack {
+		m.Capabilities = append(m.Capabilities, hlcp.CapAck)
+	}
+	if d.conf.Heartbeat {
+		m.Capabilities = append(m.Capabilities, hlcp.CapHeartbeat)
+	}
+	if kind == 'J' {
+		m.Sensors = make([]hlcp.Sensor, 0, len(d.conf.Sensors))
+		for _, s := range d.conf.Sensors {
+			m.Sensors = append(m.Sensors, hlcp.Sensor{Name: string(s.ID), Position: s.Position})
+		}
+	}
+	d.send(m)
+	if d.conf.OnIdentify != nil {
+		d.conf.OnIdentify(d, kind)
+	}
+	return nil
+}
+
+// parseCommand parses the rest of a C (AAN000) or S (AAN000T00000N) command, optionally with a sequence number (#0000).
+func parseCommand(kind byte, s string) (Command, error) {
+	if s[len(s)-1] != '\n' {
+		return Command{}, fmt.Errorf("expected EOL at end")
+	}
+	m, err := hlcp.DecodeRequest(string(kind) + s[:len(s)-1])
+	if err != nil {
+		return Command{}, err
+	}
+	switch m := m.(type) {
+	case hlcp.Change:
+		return Command{Kind: 'C', Line: m.Line, Direction: m.Direction, Brake: m.Brake, Power: m.Power, Seq: m.Seq}, nil
+	case hlcp.Switch:
+		return Command{Kind: 'S', Line: m.Line, Direction: m.Direction, Brake: m.Brake, Power: m.Power, Duration: m.Duration, BrakeAfter: m.BrakeAfter, Seq: m.Seq}, nil
+	}
+	return Command{}, fmt.Errorf("not a command: %T", m)
+}
+
+func (d *Device) apply(cmd Command) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.lines[cmd.Line] = LineState{Direction: cmd.Direction, Brake: cmd.Brake, Power: cmd.Power}
+	if st, ok := d.stops[cmd.Line]; ok {
+		st.timer.Stop()
+		close(st.canceled)
+		delete(d.stops, cmd.Line)
+	}
+	if cmd.Kind != 'S' {
+		return
+	}
+	st := &stop{timer: d.clock.NewTimer(cmd.Duration), canceled: make(chan struct{})}
+	d.stops[cmd.Line] = st
+	go func() {
+		select {
+		case <-st.timer.C:
+		case <-st.canceled:
+			return
+		}
+		d.lock.Lock()
+		if d.stops[cmd.Line] != st {
+			d.lock.Unlock()
+			return
+		}
+		delete(d.stops, cmd.Line)
+		d.lines[cmd.Line] = LineState{Direction: cmd.Direction, Brake: cmd.BrakeAfter}
+		d.lock.Unlock()
+		d.ReportShort(cmd.Line)
+	}()
+}
+
+// Line returns the state of the line.
+func (d *Device) Line(line string) LineState {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.lines[line]
+}
+
+// Println writes s and CRLF to the host, like Serial.println. It is discarded if not connected.
+func (d *Device) Println(s string) {
+	d.lock.Lock()
+	w := d.w
+	d.lock.Unlock()
+	if w == nil {
+		return
+	}
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	io.WriteString(w, s+"\r\n")
+}
+
+// send encodes and writes m to the host.
+func (d *Device) send(m hlcp.Message) {
+	s, err := hlcp.Encode(m)
+	if err != nil {
+		panic(err)
+	}
+	d.Println(s)
+}
+
+func values(values map[string]bool) []hlcp.Value {
+	result := make([]hlcp.Value, 0, len(values))
+	for k, v := range values {
+		result = append(result, hlcp.Value{Name: k, Value: v})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// ReportCurrent reports whether current flows in each line (kdss and line).
+func (d *Device) ReportCurrent(v map[string]bool) {
+	d.send(hlcp.Current{Values: values(v), Monotonic: d.millis()})
+}
+
+// ReportMilliamps reports the current in each line (kdss).
+func (d *Device) ReportMilliamps(v map[string]int) {
+	readings := make([]hlcp.Reading, 0, len(v))
+	for k, ma := range v {
+		readings = append(readings, hlcp.Reading{Name: k, Milliamps: ma})
+	}
+	sort.Slice(readings, func(i, j int) bool { return readings[i].Name < readings[j].Name })
+	d.send(hlcp.Milliamps{Values: readings, Monotonic: d.millis()})
+}
+
+// ReportShort reports that the S command for the line finished (kdss and line).
+func (d *Device) ReportShort(line string) {
+	d.send(hlcp.Short{Line: line, Monotonic: d.millis()})
+}
+
+// ReportSeen reports whether each sensor sees something (breakbeam).
+func (d *Device) ReportSeen(v map[string]bool) {
+	d.send(hlcp.Seen{Values: values(v), Monotonic: d.millis()})
+}
+
+// ReportCard reports the UID (4 or 7 bytes) of an RFID card (rfid).
+// Like the firmware, the UID is padded with zeros to 7 bytes.
+func (d *Device) ReportCard(uid []byte) {
+	padded := make([]byte, 7)
+	copy(padded, uid)
+	d.send(hlcp.Card{Reader: "card1", Length: len(uid), UID: padded})
+}
@@ -0,0 +1,117 @@
+package emulator
+
+import (
+	"bufio"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"nyiyui.ca/hato/sakayukari/clock"
+)
+
+func TestDevice(t *testing.T) {
+	v := clock.NewVirtual(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	commands := make(chan Command, 8)
+	d := New(Conf{
+		Id:      "soyuu-breakbeam/v1/test",
+		Sensors: []Sensor{{'A', 0}, {'B', 248000}},
+		Clock:   v,
+		OnCommand: func(d *Device, cmd Command) {
+			commands <- cmd
+		},
+	})
+	host := d.Pipe()
+	defer host.Close()
+	r := bufio.NewReader(host)
+	expect := func(want string) {
+		t.Helper()
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want+"\r\n" {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	io.WriteString(host, "I\n")
+	expect(" Isoyuu-breakbeam/v1/test")
+	io.WriteString(host, "J\n")
+	expect(" Isoyuu-breakbeam/v1/test;JAP0 JBP248000")
+
+	io.WriteString(host, "f090gD087")
+	expect(" Eunknown kind 68")
+	expect(" Eunknown kind 48")
+	expect(" Eunknown kind 56")
+	expect(" Eunknown kind 55")
+
+	io.WriteString(host, "CBAN100\n")
+	expect(" Ook")
+	if diff := cmp.Diff(Command{Kind: 'C', Line: "B", Direction: true, Power: 100}, <-commands); diff != "" {
+		t.Fatalf("C (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(LineState{Direction: true, Power: 100}, d.Line("B")); diff != "" {
+		t.Fatalf("line B (-want +got):\n%s", diff)
+	}
+
+	io.WriteString(host, "SABN070T00500Y\n")
+	expect(" Ook")
+	want := Command{Kind: 'S', Line: "A", Power: 70, Duration: 500 * time.Millisecond, BrakeAfter: true}
+	if diff := cmp.Diff(want, <-commands); diff != "" {
+		t.Fatalf("S (-want +got):\n%s", diff)
+	}
+	v.BlockUntil(1)
+	v.Advance(500 * time.Millisecond)
+	expect(" DSLAT500")
+	if diff := cmp.Diff(LineState{Brake: true}, d.Line("A")); diff != "" {
+		t.Fatalf("line A (-want +got):\n%s", diff)
+	}
+
+	go d.ReportSeen(map[string]bool{"B": false, "A": true})
+	expect(" DA1B0T500")
+	go d.ReportCard([]byte{0xde, 0xad, 0xbe, 0xef})
+	expect(" DNcard1 L4 VDEADBEEF000000")
+
+	d.Disconnect()
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("read after disconnect: %v", err)
+	}
+}
+
+func TestFailsafe(t *testing.T) {
+	v := clock.NewVirtual(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := New(Conf{Id: "soyuu-kdss/v4/test", Clock: v, Heartbeat: true})
+	host := d.Pipe()
+	defer host.Close()
+	r := bufio.NewReader(host)
+	expect := func(want string) {
+		t.Helper()
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want+"\r\n" {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	io.WriteString(host, "I\n")
+	expect(" Isoyuu-kdss/v4/test +heartbeat")
+	io.WriteString(host, "CAAN100\n")
+	expect(" Ook")
+	io.WriteString(host, "P01000\n")
+	expect(" PT0")
+	v.Advance(900 * time.Millisecond)
+	io.WriteString(host, "P01000\n")
+	expect(" PT900")
+	v.Advance(900 * time.Millisecond)
+	if diff := cmp.Diff(LineState{Direction: true, Power: 100}, d.Line("A")); diff != "" {
+		t.Fatalf("before timeout (-want +got):\n%s", diff)
+	}
+	go v.Advance(100 * time.Millisecond)
+	expect(" Efailsafe: no heartbeat")
+	if diff := cmp.Diff(LineState{Direction: true}, d.Line("A")); diff != "" {
+		t.Fatalf("after timeout (-want +got):\n%s", diff)
+	}
+}
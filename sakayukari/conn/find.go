@@ -2,14 +2,16 @@ package conn
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"log"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+
+	"nyiyui.ca/hato/sakayukari/conn/hlcp"
 )
 
 func (s *State) find() error {
@@ -19,6 +21,7 @@ func (s *State) find() error {
 	}
 	s.connsLock.Lock()
 	defer s.connsLock.Unlock()
+	matches = append(matches, s.networkPaths()...)
 	var wg sync.WaitGroup
 	for _, match := range matches {
 		if _, ok := s.conns[match]; ok {
@@ -31,7 +34,7 @@ func (s *State) find() error {
 	return nil
 }
 
-// connect connects to a serial port on specified path and creates a new Conn for it.
+// connect connects to a serial port (or network device) on specified path and creates a new Conn for it.
 // State.connsLock must be locked at call site.
 func (s *State) connect(wg *sync.WaitGroup, path string) {
 	doneSent := false
@@ -41,65 +44,116 @@ func (s *State) connect(wg *sync.WaitGroup, path string) {
 		}
 	}()
 	log.Printf("connecting to %s", path)
-	cmd := exec.Command("./serial-proxy", path)
-	stdin, err := cmd.StdinPipe()
+	c, err := s.openAttach(path)
 	if err != nil {
-		log.Printf("connect %s: StdinPipe: %s", path, err)
+		log.Printf("connect %s: %s", path, err)
 		return
 	}
-	defer stdin.Close()
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Printf("connect %s: StdoutPipe: %s", path, err)
-		return
+	// log.Printf("connected to %s %s", path, c.Id)
+	s.conns[path] = c
+	wg.Done()
+	doneSent = true
+	s.handleConn(c)
+	c.F.(io.Closer).Close()
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	delete(s.conns, path)
+}
+
+// openAttach opens the port at path, and attaches to the device on it.
+// As the device's id (and so its baud rate) is only known after attaching, serial ports are tried at each rate from s.bauds.
+// State.connsLock must be locked at call site.
+func (s *State) openAttach(path string) (*Conn, error) {
+	if nc, ok, err := dialNetwork(path); ok {
+		if err != nil {
+			return nil, err
+		}
+		c, err := attach(path, nc)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	errs := []string{}
+	for _, baud := range s.bauds(path) {
+		conf := s.serial
+		conf.Baud = baud
+		f, err := s.openSerial(path, conf)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%d baud: %s", baud, err))
+			continue
+		}
+		c, err := attach(path, f)
+		if err != nil {
+			f.Close()
+			errs = append(errs, fmt.Sprintf("%d baud: %s", baud, err))
+			continue
+		}
+		s.pathBauds[path] = baud
+		return c, nil
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+func (s *State) openSerial(path string, conf SerialConf) (io.ReadWriteCloser, error) {
+	if s.open != nil {
+		return s.open(path, conf)
 	}
-	defer stdout.Close()
-	cmd.Stderr = os.Stderr
-	err = cmd.Start()
+	f, err := OpenSerial(path, conf)
 	if err != nil {
-		log.Printf("connect %s: %s", path, err)
-		return
+		return nil, err
 	}
-	defer cmd.Process.Signal(os.Interrupt)
-	time.Sleep(1 * time.Second)
-	_, err = stdin.Write([]byte("I\n"))
+	return f, nil
+}
+
+// identifyTimeout is how long attach waits for a device to reply with its id.
+const identifyTimeout = 5 * time.Second
+
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// attach asks the device on f for its id, and returns a Conn for it.
+func attach(path string, f io.ReadWriteCloser) (*Conn, error) {
+	if d, ok := f.(deadliner); ok {
+		err := d.SetReadDeadline(time.Now().Add(identifyTimeout))
+		if err != nil {
+			return nil, err
+		}
+		defer d.SetReadDeadline(time.Time{})
+	}
+	_, err := f.Write([]byte("I\n"))
 	if err != nil {
-		log.Printf("connect %s: %s", path, err)
-		return
+		return nil, err
 	}
-	reader := bufio.NewReader(stdout)
+	reader := bufio.NewReader(f)
 	var line string
 	for !strings.HasPrefix(line, " I") {
-		// log.Printf("connect %s: read %s", path, strconv.Quote(line))
 		line, err = reader.ReadString('\n')
 		if err != nil {
-			log.Printf("connect %s: reading id: %s", path, err)
-			return
+			return nil, fmt.Errorf("reading id: %w", err)
 		}
 	}
-	if len(line) <= 2 {
-		log.Printf("connect %s: not enough id: %s", path, line)
-		return
-	}
-	line = strings.TrimSpace(line[2:])
-	id := ParseId(line)
-	// log.Printf("connected to %s %s", path, id)
-	c := &Conn{
-		Id:   id,
-		Path: path,
-		F:    &combinedReadWriter{r: stdout, w: stdin},
+	id, err := hlcp.DecodeId(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		return nil, err
 	}
-	// TODO: flush stdin on write
-	s.conns[path] = c
-	wg.Done()
-	doneSent = true
-	s.handleConn(c)
+	return &Conn{
+		Id:           ParseId(id.Id),
+		Path:         path,
+		F:            &bufferedConn{r: reader, f: f},
+		Capabilities: id.Capabilities,
+	}, nil
 }
 
-type combinedReadWriter struct {
-	r io.Reader
-	w io.Writer
+// bufferedConn reads through r, which may have buffered bytes read from f while identifying.
+type bufferedConn struct {
+	r *bufio.Reader
+	f io.ReadWriteCloser
 }
 
-func (c *combinedReadWriter) Read(p []byte) (n int, err error)  { return c.r.Read(p) }
-func (c *combinedReadWriter) Write(p []byte) (n int, err error) { return c.w.Write(p) }
+func (c *bufferedConn) Read(p []byte) (n int, err error)  { return c.r.Read(p) }
+func (c *bufferedConn) Write(p []byte) (n int, err error) { return c.f.Write(p) }
+func (c *bufferedConn) Close() error                      { return c.f.Close() }
+func (c *bufferedConn) Flush() error                      { return flush(c.f) }
@@ -0,0 +1,78 @@
+package conn
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/conn/emulator"
+)
+
+func TestConnect(t *testing.T) {
+	id := Id{Type: "soyuu-kdss", Variant: "v4", Instance: "test"}
+	s, as := ConnActors([]Id{id})
+	a := as[0]
+	d := emulator.New(emulator.Conf{Id: id.String()})
+	s.open = func(path string, conf SerialConf) (io.ReadWriteCloser, error) { return d.Pipe(), nil }
+	connect := func(path string) {
+		s.connsLock.Lock()
+		defer s.connsLock.Unlock()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go s.connect(&wg, path)
+		wg.Wait()
+	}
+
+	connect("/dev/ttyACM0")
+	if diff := cmp.Diff(ValConnState{Id: id, Path: "/dev/ttyACM0", Up: true}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("up (-want +got):\n%s", diff)
+	}
+	a.InputCh <- Diffuse1{Value: ReqLine{Line: "A", Power: 100}}
+	waitLine(t, d, "A", emulator.LineState{Power: 100})
+
+	d.Disconnect()
+	if diff := cmp.Diff(ValConnState{Id: id, Path: "/dev/ttyACM0", Up: false}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("down (-want +got):\n%s", diff)
+	}
+
+	connect("/dev/ttyACM1")
+	if diff := cmp.Diff(ValConnState{Id: id, Path: "/dev/ttyACM1", Up: true}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("up again (-want +got):\n%s", diff)
+	}
+	a.InputCh <- Diffuse1{Value: ReqLine{Line: "A", Power: 50}}
+	waitLine(t, d, "A", emulator.LineState{Power: 50})
+}
+
+func TestConnectBaud(t *testing.T) {
+	id := Id{Type: "soyuu-rfid", Variant: "v2", Instance: "test"}
+	s, as := ConnActors([]Id{id})
+	s.SetBaud(id, 115200)
+	d := emulator.New(emulator.Conf{Id: id.String()})
+	tried := []int{}
+	s.open = func(path string, conf SerialConf) (io.ReadWriteCloser, error) {
+		tried = append(tried, conf.Baud)
+		if conf.Baud != 115200 {
+			return nil, errors.New("garbled")
+		}
+		return d.Pipe(), nil
+	}
+	s.connsLock.Lock()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go s.connect(&wg, "/dev/ttyACM0")
+	wg.Wait()
+	s.connsLock.Unlock()
+	if diff := cmp.Diff(ValConnState{Id: id, Path: "/dev/ttyACM0", Up: true}, (<-as[0].OutputCh).Value); diff != "" {
+		t.Fatalf("up (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]int{DefaultBaud, 115200}, tried); diff != "" {
+		t.Fatalf("tried (-want +got):\n%s", diff)
+	}
+	// the device's rate is tried first when it reconnects
+	if diff := cmp.Diff([]int{115200, DefaultBaud}, s.bauds("/dev/ttyACM0")); diff != "" {
+		t.Fatalf("bauds (-want +got):\n%s", diff)
+	}
+}
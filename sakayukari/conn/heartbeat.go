@@ -0,0 +1,95 @@
+package conn
+
+import (
+	"log"
+	"time"
+
+	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/clock"
+	"nyiyui.ca/hato/sakayukari/conn/hlcp"
+)
+
+const (
+	DefaultHeartbeatInterval = 500 * time.Millisecond
+	DefaultHeartbeatTimeout  = 2 * time.Second
+)
+
+// HeartbeatConf configures heartbeats to line devices that support them (see hlcp.CapHeartbeat).
+type HeartbeatConf struct {
+	// Interval is how often the device is pinged. If 0, DefaultHeartbeatInterval is used.
+	Interval time.Duration
+	// Timeout is how long without a ping before the device turns off all lines, and how long without a pong before ValHeartbeat reports the device is not alive. If 0, DefaultHeartbeatTimeout is used.
+	Timeout time.Duration
+	// Clock measures Interval and Timeout. If nil, clock.Real is used.
+	Clock clock.Clock
+}
+
+func (c HeartbeatConf) interval() time.Duration {
+	if c.Interval == 0 {
+		return DefaultHeartbeatInterval
+	}
+	return c.Interval
+}
+
+func (c HeartbeatConf) clk() clock.Clock {
+	return clock.Or(c.Clock)
+}
+
+func (c HeartbeatConf) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultHeartbeatTimeout
+	}
+	return c.Timeout
+}
+
+// SetHeartbeatConf sets the heartbeats of devices connected from now on.
+func (s *State) SetHeartbeatConf(conf HeartbeatConf) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	s.heartbeat = conf
+}
+
+// heartbeat pings the device until stopped is closed, and publishes a ValHeartbeat whenever the device stops (or starts again) replying in time.
+func (state *lineState) heartbeat(a Actor, c *Conn, stopped <-chan struct{}) {
+	clk := c.Heartbeat.clk()
+	ticker := clk.NewTicker(c.Heartbeat.interval())
+	defer ticker.Stop()
+	ping := hlcp.Ping{Timeout: c.Heartbeat.timeout()}
+	alive := true
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-ticker.C:
+		}
+		err := state.writeMessage(c, ping)
+		if err != nil {
+			// reading fails too, so the handler stops
+			log.Printf("%s: ping: %s", c.Path, err)
+			return
+		}
+		state.pongLock.Lock()
+		alive2 := clk.Since(state.lastPong) < c.Heartbeat.timeout()
+		state.pongLock.Unlock()
+		if alive2 != alive {
+			alive = alive2
+			if !alive {
+				state.forget.Store(true)
+			}
+			v := ValHeartbeat{Alive: alive}
+			log.Printf("%s: %s", c.Path, v)
+			select {
+			case a.OutputCh <- Diffuse1{Value: v}:
+			case <-stopped:
+				return
+			}
+		}
+	}
+}
+
+// pong records a pong from the device, received at now.
+func (state *lineState) pong(now time.Time) {
+	state.pongLock.Lock()
+	defer state.pongLock.Unlock()
+	state.lastPong = now
+}
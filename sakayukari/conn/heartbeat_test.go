@@ -0,0 +1,56 @@
+package conn
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/conn/emulator"
+)
+
+func TestHeartbeat(t *testing.T) {
+	var lose atomic.Bool
+	var pings atomic.Int32
+	d := emulator.New(emulator.Conf{
+		Id:        "soyuu-kdss/v4/test",
+		Heartbeat: true,
+		LosePing: func() bool {
+			pings.Add(1)
+			return lose.Load()
+		},
+	})
+	c, err := attach("/dev/test0", d.Pipe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Heartbeat = HeartbeatConf{Interval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond}
+	a := handlerLine{}.NewBlankActor()
+	go handlerLine{}.HandleConn(a, c)
+
+	a.InputCh <- Diffuse1{Value: ReqLine{Line: "A", Power: 100}}
+	waitLine(t, d, "A", emulator.LineState{Power: 100})
+
+	// the failsafe starts with the first ping
+	for pings.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// e.g. the device hangs, or the host is too busy to ping
+	lose.Store(true)
+	if diff := cmp.Diff(ValHeartbeat{Alive: false}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("missing (-want +got):\n%s", diff)
+	}
+	// the device turns off lines by itself
+	waitLine(t, d, "A", emulator.LineState{})
+
+	lose.Store(false)
+	if diff := cmp.Diff(ValHeartbeat{Alive: true}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("alive (-want +got):\n%s", diff)
+	}
+	// sent again, although it was the last ReqLine sent
+	a.InputCh <- Diffuse1{Value: ReqLine{Line: "A", Power: 100}}
+	waitLine(t, d, "A", emulator.LineState{Power: 100})
+	close(a.InputCh)
+	<-a.Done
+}
@@ -0,0 +1,693 @@
+// Package hlcp encodes and decodes messages of the line control protocol spoken by soyuu devices over serial.
+//
+// The host sends requests (e.g. "CAAN100"), each terminated by "\n".
+// Devices send lines terminated by "\r\n"; lines for the host start with a space and a kind (e.g. " DCA1B0T1234"), and other lines are debug output.
+// Encode and the Decode functions work on single lines without terminators.
+package hlcp
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSyntax   = errors.New("syntax error")
+	ErrLine     = errors.New("line must be a letter from A to Z")
+	ErrPower    = errors.New("power must be 3 digits from 000 to 255")
+	ErrDuration = errors.New("duration must be whole milliseconds from 0 to 99999 ms")
+	ErrSeq      = errors.New("sequence number must be 4 digits from 0001 to 9999")
+	ErrCurrent  = errors.New("current must be a non-negative number of mA")
+)
+
+// CapHeartbeat is the capability of devices that reply to Ping with Pong, and turn off all lines if Pings stop.
+const CapHeartbeat = "heartbeat"
+
+// CapAck is the capability of devices that acknowledge Change and Switch with a Seq (with Ack or Nack).
+const CapAck = "ack"
+
+// MaxSeq is the largest sequence number.
+const MaxSeq = 9999
+
+// Error is returned for invalid messages. Err is one of the Err* variables.
+type Error struct {
+	// Message is the (partially) encoded or decoded message.
+	Message string
+	Err     error
+	// Detail, if not empty, describes what is wrong.
+	Detail string
+}
+
+func (e *Error) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("hlcp: %q: %s", e.Message, e.Err)
+	}
+	return fmt.Sprintf("hlcp: %q: %s: %s", e.Message, e.Err, e.Detail)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// MaxDuration is the longest duration of a Switch.
+const MaxDuration = 99999 * time.Millisecond
+
+// Message is one of the types in this package.
+type Message interface {
+	isMessage()
+}
+
+// Identify (I) asks the device for its Id.
+type Identify struct{}
+
+// ListSensors (J) asks the device for its Id with Sensors.
+type ListSensors struct{}
+
+// Change (C) sets the output of a line.
+type Change struct {
+	Line string
+	// Direction is true for A, and false for B.
+	Direction bool
+	Brake     bool
+	Power     uint8
+	// Seq, if not 0, is the sequence number to acknowledge (see CapAck).
+	Seq int
+}
+
+// Switch (S) sets the output of a line for Duration, and then sets power to 0 (with brake if BrakeAfter).
+// After Duration, the device sends a Short.
+type Switch struct {
+	Line string
+	// Direction is true for A, and false for B.
+	Direction  bool
+	Brake      bool
+	Power      uint8
+	Duration   time.Duration
+	BrakeAfter bool
+	// Seq, if not 0, is the sequence number to acknowledge (see CapAck).
+	Seq int
+}
+
+// Ping (P) asks the device for a Pong. After the first Ping, the device turns off all lines if it does not receive a Ping for Timeout (see CapHeartbeat).
+type Ping struct {
+	Timeout time.Duration
+}
+
+// Pong ( P) is the reply to Ping.
+type Pong struct {
+	// Monotonic is the device's time in ms.
+	Monotonic int64
+}
+
+// Id ( I) is the reply to Identify or ListSensors.
+type Id struct {
+	// Id is e.g. "soyuu-kdss/v4/peach".
+	Id string
+	// Capabilities are e.g. CapAck. Devices without capabilities (e.g. older firmware) send none.
+	Capabilities []string
+	// Sensors are only replied to ListSensors.
+	Sensors []Sensor
+}
+
+type Sensor struct {
+	Name string
+	// Position is in µm.
+	Position int64
+}
+
+// Value is the state of a line (e.g. whether current flows) or sensor.
+type Value struct {
+	Name  string
+	Value bool
+}
+
+// Current ( DC) reports whether current flows in each line.
+type Current struct {
+	Values []Value
+	// Monotonic is the device's time in ms.
+	Monotonic int64
+}
+
+// Milliamps ( DI) reports the current in each line.
+type Milliamps struct {
+	Values []Reading
+	// Monotonic is the device's time in ms.
+	Monotonic int64
+}
+
+// Reading is the current in a line.
+type Reading struct {
+	Name      string
+	Milliamps int
+}
+
+// Short ( DSL) reports that the Duration of a Switch elapsed.
+type Short struct {
+	Line string
+	// Monotonic is the device's time in ms.
+	Monotonic int64
+}
+
+// Seen ( D) reports whether each breakbeam sensor sees something.
+type Seen struct {
+	Values []Value
+	// Monotonic is the device's time in ms.
+	Monotonic int64
+}
+
+// Card ( DN) reports the UID of an RFID card.
+type Card struct {
+	Reader string
+	// Length is the length of the card's UID (4 or 7).
+	Length int
+	// UID is as sent by the device; the rfid firmware always sends 7 bytes, padding shorter UIDs.
+	UID []byte
+}
+
+// Ack ( A) acknowledges that the Change or Switch with Seq was applied.
+type Ack struct {
+	Seq int
+}
+
+// Nack ( X) reports that the Change or Switch with Seq was not applied.
+type Nack struct {
+	Seq    int
+	Reason string
+}
+
+// DeviceError ( E) reports an error on the device.
+type DeviceError struct {
+	Message string
+}
+
+func (Identify) isMessage()    {}
+func (ListSensors) isMessage() {}
+func (Change) isMessage()      {}
+func (Switch) isMessage()      {}
+func (Ping) isMessage()        {}
+func (Pong) isMessage()        {}
+func (Id) isMessage()          {}
+func (Current) isMessage()     {}
+func (Milliamps) isMessage()   {}
+func (Short) isMessage()       {}
+func (Seen) isMessage()        {}
+func (Card) isMessage()        {}
+func (Ack) isMessage()         {}
+func (Nack) isMessage()        {}
+func (DeviceError) isMessage() {}
+
+func validLine(line string) bool {
+	return len(line) == 1 && line[0] >= 'A' && line[0] <= 'Z'
+}
+
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " ;\r\n")
+}
+
+func validSeq(seq int) bool {
+	return seq >= 1 && seq <= MaxSeq
+}
+
+// formatSeq appends the sequence number of a Change or Switch, if any.
+func formatSeq(b *strings.Builder, seq int) error {
+	if seq == 0 {
+		return nil
+	}
+	if !validSeq(seq) {
+		return ErrSeq
+	}
+	fmt.Fprintf(b, "#%04d", seq)
+	return nil
+}
+
+func direction(d bool) byte {
+	if d {
+		return 'A'
+	}
+	return 'B'
+}
+
+func yesNo(b bool) byte {
+	if b {
+		return 'Y'
+	}
+	return 'N'
+}
+
+func formatValues(b *strings.Builder, values []Value) error {
+	for _, v := range values {
+		if !validLine(v.Name) {
+			return ErrLine
+		}
+		b.WriteString(v.Name)
+		if v.Value {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+	return nil
+}
+
+// Encode returns m encoded, without a line terminator.
+func Encode(m Message) (string, error) {
+	var b strings.Builder
+	var err error
+	switch m := m.(type) {
+	case Identify:
+		b.WriteString("I")
+	case ListSensors:
+		b.WriteString("J")
+	case Change:
+		if !validLine(m.Line) {
+			err = ErrLine
+			break
+		}
+		fmt.Fprintf(&b, "C%s%c%c%03d", m.Line, direction(m.Direction), yesNo(m.Brake), m.Power)
+		err = formatSeq(&b, m.Seq)
+	case Switch:
+		if !validLine(m.Line) {
+			err = ErrLine
+			break
+		}
+		if m.Duration < 0 || m.Duration > MaxDuration || m.Duration%time.Millisecond != 0 {
+			err = ErrDuration
+			break
+		}
+		fmt.Fprintf(&b, "S%s%c%c%03dT%05d%c", m.Line, direction(m.Direction), yesNo(m.Brake), m.Power, m.Duration.Milliseconds(), yesNo(m.BrakeAfter))
+		err = formatSeq(&b, m.Seq)
+	case Ping:
+		if m.Timeout < 0 || m.Timeout > MaxDuration || m.Timeout%time.Millisecond != 0 {
+			err = ErrDuration
+			break
+		}
+		fmt.Fprintf(&b, "P%05d", m.Timeout.Milliseconds())
+	case Pong:
+		fmt.Fprintf(&b, " PT%d", m.Monotonic)
+	case Id:
+		if !validName(m.Id) {
+			err = ErrSyntax
+			break
+		}
+		fmt.Fprintf(&b, " I%s", m.Id)
+		for _, c := range m.Capabilities {
+			if !validName(c) {
+				err = ErrSyntax
+				break
+			}
+			fmt.Fprintf(&b, " +%s", c)
+		}
+		if err != nil || m.Sensors == nil {
+			break
+		}
+		b.WriteByte(';')
+		for i, s := range m.Sensors {
+			if !validLine(s.Name) {
+				err = ErrLine
+				break
+			}
+			if i != 0 {
+				b.WriteByte(' ')
+			}
+			fmt.Fprintf(&b, "J%sP%d", s.Name, s.Position)
+		}
+	case Current:
+		b.WriteString(" DC")
+		err = formatValues(&b, m.Values)
+		fmt.Fprintf(&b, "T%d", m.Monotonic)
+	case Milliamps:
+		b.WriteString(" DI")
+		for _, r := range m.Values {
+			if !validLine(r.Name) {
+				err = ErrLine
+				break
+			}
+			if r.Milliamps < 0 {
+				err = ErrCurrent
+				break
+			}
+			fmt.Fprintf(&b, "%s%d ", r.Name, r.Milliamps)
+		}
+		fmt.Fprintf(&b, "T%d", m.Monotonic)
+	case Short:
+		if !validLine(m.Line) {
+			err = ErrLine
+			break
+		}
+		fmt.Fprintf(&b, " DSL%sT%d", m.Line, m.Monotonic)
+	case Seen:
+		b.WriteString(" D")
+		err = formatValues(&b, m.Values)
+		fmt.Fprintf(&b, "T%d", m.Monotonic)
+	case Card:
+		if !validName(m.Reader) || m.Length < 0 || m.Length > len(m.UID) {
+			err = ErrSyntax
+			break
+		}
+		fmt.Fprintf(&b, " DN%s L%d V%s", m.Reader, m.Length, strings.ToUpper(hex.EncodeToString(m.UID)))
+	case Ack:
+		if !validSeq(m.Seq) {
+			err = ErrSeq
+			break
+		}
+		fmt.Fprintf(&b, " A%04d", m.Seq)
+	case Nack:
+		if !validSeq(m.Seq) {
+			err = ErrSeq
+			break
+		}
+		fmt.Fprintf(&b, " X%04d %s", m.Seq, m.Reason)
+	case DeviceError:
+		fmt.Fprintf(&b, " E%s", m.Message)
+	default:
+		panic(fmt.Sprintf("unknown message type %T", m))
+	}
+	if err != nil {
+		return "", &Error{Message: b.String(), Err: err, Detail: fmt.Sprintf("%#v", m)}
+	}
+	return b.String(), nil
+}
+
+func syntaxError(s, detail string) error {
+	return &Error{Message: s, Err: ErrSyntax, Detail: detail}
+}
+
+// parseDigits parses a decimal number of exactly n digits.
+func parseDigits(s string, n int) (uint64, bool) {
+	if len(s) != n {
+		return 0, false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	return v, err == nil
+}
+
+func parseDirection(c byte) (bool, bool) {
+	switch c {
+	case 'A':
+		return true, true
+	case 'B':
+		return false, true
+	}
+	return false, false
+}
+
+func parseYesNo(c byte) (bool, bool) {
+	switch c {
+	case 'Y':
+		return true, true
+	case 'N':
+		return false, true
+	}
+	return false, false
+}
+
+// DecodeRequest decodes a request sent by the host (Identify, ListSensors, Change, Switch, or Ping).
+func DecodeRequest(s string) (Message, error) {
+	if s == "" {
+		return nil, syntaxError(s, "empty")
+	}
+	switch s[0] {
+	case 'I', 'J':
+		if len(s) != 1 {
+			return nil, syntaxError(s, "trailing characters")
+		}
+		if s[0] == 'I' {
+			return Identify{}, nil
+		}
+		return ListSensors{}, nil
+	case 'C':
+		seq, err := decodeSeq(s, len("CAAN000"))
+		if err != nil {
+			return nil, err
+		}
+		line, dir, brake, power, err := decodeOutput(s)
+		if err != nil {
+			return nil, err
+		}
+		return Change{Line: line, Direction: dir, Brake: brake, Power: power, Seq: seq}, nil
+	case 'S':
+		seq, err := decodeSeq(s, len("SAAN000T00000N"))
+		if err != nil {
+			return nil, err
+		}
+		line, dir, brake, power, err := decodeOutput(s)
+		if err != nil {
+			return nil, err
+		}
+		if s[7] != 'T' {
+			return nil, syntaxError(s, "expected T")
+		}
+		duration, ok := parseDigits(s[8:13], 5)
+		if !ok {
+			return nil, &Error{Message: s, Err: ErrDuration}
+		}
+		brakeAfter, ok := parseYesNo(s[13])
+		if !ok {
+			return nil, syntaxError(s, "brake after must be Y or N")
+		}
+		return Switch{Line: line, Direction: dir, Brake: brake, Power: power, Duration: time.Duration(duration) * time.Millisecond, BrakeAfter: brakeAfter, Seq: seq}, nil
+	case 'P':
+		if len(s) != len("P00000") {
+			return nil, syntaxError(s, "wrong length")
+		}
+		timeout, ok := parseDigits(s[1:], 5)
+		if !ok {
+			return nil, &Error{Message: s, Err: ErrDuration}
+		}
+		return Ping{Timeout: time.Duration(timeout) * time.Millisecond}, nil
+	}
+	return nil, syntaxError(s, fmt.Sprintf("unknown kind %q", s[0]))
+}
+
+// decodeSeq decodes the sequence number after the first n bytes of a Change or Switch, if any.
+func decodeSeq(s string, n int) (int, error) {
+	switch len(s) {
+	case n:
+		return 0, nil
+	case n + len("#0000"):
+		if s[n] != '#' {
+			return 0, syntaxError(s, "expected #")
+		}
+		seq, ok := parseDigits(s[n+1:], 4)
+		if !ok || !validSeq(int(seq)) {
+			return 0, &Error{Message: s, Err: ErrSeq}
+		}
+		return int(seq), nil
+	}
+	return 0, syntaxError(s, "wrong length")
+}
+
+// decodeOutput decodes the line, direction, brake, and power of C or S.
+func decodeOutput(s string) (line string, dir, brake bool, power uint8, err error) {
+	line = s[1:2]
+	if !validLine(line) {
+		return "", false, false, 0, &Error{Message: s, Err: ErrLine}
+	}
+	dir, ok := parseDirection(s[2])
+	if !ok {
+		return "", false, false, 0, syntaxError(s, "direction must be A or B")
+	}
+	brake, ok = parseYesNo(s[3])
+	if !ok {
+		return "", false, false, 0, syntaxError(s, "brake must be Y or N")
+	}
+	p, ok := parseDigits(s[4:7], 3)
+	if !ok || p > 255 {
+		return "", false, false, 0, &Error{Message: s, Err: ErrPower}
+	}
+	return line, dir, brake, uint8(p), nil
+}
+
+// DecodeId decodes a reply to Identify or ListSensors.
+func DecodeId(s string) (Id, error) {
+	if !strings.HasPrefix(s, " I") {
+		return Id{}, syntaxError(s, "expected \" I\"")
+	}
+	head, sensorsRaw, hasSensors := strings.Cut(s[2:], ";")
+	fields := strings.Split(head, " ")
+	if !validName(fields[0]) {
+		return Id{}, syntaxError(s, "invalid id")
+	}
+	m := Id{Id: fields[0]}
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "+") || !validName(field[1:]) {
+			return Id{}, syntaxError(s, fmt.Sprintf("capability %q", field))
+		}
+		m.Capabilities = append(m.Capabilities, field[1:])
+	}
+	if !hasSensors {
+		return m, nil
+	}
+	m.Sensors = []Sensor{}
+	if sensorsRaw == "" {
+		return m, nil
+	}
+	for _, raw := range strings.Split(sensorsRaw, " ") {
+		// JAP248000
+		if len(raw) < 4 || raw[0] != 'J' || raw[2] != 'P' {
+			return Id{}, syntaxError(s, fmt.Sprintf("sensor %q", raw))
+		}
+		if !validLine(raw[1:2]) {
+			return Id{}, &Error{Message: s, Err: ErrLine, Detail: fmt.Sprintf("sensor %q", raw)}
+		}
+		pos, err := strconv.ParseInt(raw[3:], 10, 64)
+		if err != nil {
+			return Id{}, syntaxError(s, fmt.Sprintf("sensor %q: %s", raw, err))
+		}
+		m.Sensors = append(m.Sensors, Sensor{Name: raw[1:2], Position: pos})
+	}
+	return m, nil
+}
+
+// decodeValues decodes e.g. "A1B0T1234".
+func decodeValues(s, values string) ([]Value, int64, error) {
+	result := make([]Value, 0, 4)
+	for {
+		if values == "" {
+			return nil, 0, syntaxError(s, "expected T")
+		}
+		if values[0] == 'T' {
+			break
+		}
+		if len(values) < 2 || !validLine(values[0:1]) {
+			return nil, 0, &Error{Message: s, Err: ErrLine}
+		}
+		switch values[1] {
+		case '0', '1':
+		default:
+			return nil, 0, syntaxError(s, fmt.Sprintf("value of %c must be 0 or 1", values[0]))
+		}
+		result = append(result, Value{Name: values[0:1], Value: values[1] == '1'})
+		values = values[2:]
+	}
+	monotonic, err := strconv.ParseInt(values[1:], 10, 64)
+	if err != nil {
+		return nil, 0, syntaxError(s, fmt.Sprintf("T: %s", err))
+	}
+	return result, monotonic, nil
+}
+
+// DecodeLineReport decodes a Current, Milliamps, Short, Ack, Nack, or Pong from a kdss or line device.
+func DecodeLineReport(s string) (Message, error) {
+	switch {
+	case strings.HasPrefix(s, " PT"):
+		monotonic, err := strconv.ParseInt(s[3:], 10, 64)
+		if err != nil {
+			return nil, syntaxError(s, fmt.Sprintf("T: %s", err))
+		}
+		return Pong{Monotonic: monotonic}, nil
+	case strings.HasPrefix(s, " DI"):
+		return decodeMilliamps(s)
+	case strings.HasPrefix(s, " DC"):
+		values, monotonic, err := decodeValues(s, s[3:])
+		if err != nil {
+			return nil, err
+		}
+		return Current{Values: values, Monotonic: monotonic}, nil
+	case strings.HasPrefix(s, " DSL"):
+		// " DSLAT16387"
+		if len(s) < 6 || s[5] != 'T' {
+			return nil, syntaxError(s, "expected line and T")
+		}
+		if !validLine(s[4:5]) {
+			return nil, &Error{Message: s, Err: ErrLine}
+		}
+		monotonic, err := strconv.ParseInt(s[6:], 10, 64)
+		if err != nil {
+			return nil, syntaxError(s, fmt.Sprintf("T: %s", err))
+		}
+		return Short{Line: s[4:5], Monotonic: monotonic}, nil
+	case strings.HasPrefix(s, " A"):
+		seq, ok := parseDigits(s[2:], 4)
+		if !ok || !validSeq(int(seq)) {
+			return nil, &Error{Message: s, Err: ErrSeq}
+		}
+		return Ack{Seq: int(seq)}, nil
+	case strings.HasPrefix(s, " X"):
+		if len(s) < len(" X0000") {
+			return nil, &Error{Message: s, Err: ErrSeq}
+		}
+		seq, ok := parseDigits(s[2:6], 4)
+		if !ok || !validSeq(int(seq)) {
+			return nil, &Error{Message: s, Err: ErrSeq}
+		}
+		return Nack{Seq: int(seq), Reason: strings.TrimPrefix(s[6:], " ")}, nil
+	}
+	return nil, syntaxError(s, "expected \" DC\", \" DI\", \" DSL\", \" A\", \" X\", or \" PT\"")
+}
+
+// decodeMilliamps decodes e.g. " DIA120 B0 T1234".
+func decodeMilliamps(s string) (Milliamps, error) {
+	fields := strings.Split(s[3:], " ")
+	last := fields[len(fields)-1]
+	if !strings.HasPrefix(last, "T") {
+		return Milliamps{}, syntaxError(s, "expected T")
+	}
+	monotonic, err := strconv.ParseInt(last[1:], 10, 64)
+	if err != nil {
+		return Milliamps{}, syntaxError(s, fmt.Sprintf("T: %s", err))
+	}
+	m := Milliamps{Values: make([]Reading, 0, len(fields)-1), Monotonic: monotonic}
+	for _, field := range fields[:len(fields)-1] {
+		if len(field) < 2 || !validLine(field[:1]) {
+			return Milliamps{}, &Error{Message: s, Err: ErrLine}
+		}
+		ma, ok := parseDigits(field[1:], len(field)-1)
+		if !ok || ma > math.MaxInt32 {
+			return Milliamps{}, &Error{Message: s, Err: ErrCurrent, Detail: fmt.Sprintf("line %s", field[:1])}
+		}
+		m.Values = append(m.Values, Reading{Name: field[:1], Milliamps: int(ma)})
+	}
+	return m, nil
+}
+
+// DecodeSeen decodes a Seen from a breakbeam device.
+func DecodeSeen(s string) (Seen, error) {
+	if !strings.HasPrefix(s, " D") {
+		return Seen{}, syntaxError(s, "expected \" D\"")
+	}
+	values, monotonic, err := decodeValues(s, s[2:])
+	if err != nil {
+		return Seen{}, err
+	}
+	return Seen{Values: values, Monotonic: monotonic}, nil
+}
+
+// DecodeCard decodes a Card from an rfid device.
+func DecodeCard(s string) (Card, error) {
+	// " DNcard1 L4 VDEADBEEF"
+	if !strings.HasPrefix(s, " DN") {
+		return Card{}, syntaxError(s, "expected \" DN\"")
+	}
+	parts := strings.Split(s[3:], " ")
+	if len(parts) != 3 || !strings.HasPrefix(parts[1], "L") || !strings.HasPrefix(parts[2], "V") {
+		return Card{}, syntaxError(s, "expected reader, L, and V")
+	}
+	length, err := strconv.Atoi(parts[1][1:])
+	if err != nil {
+		return Card{}, syntaxError(s, fmt.Sprintf("L: %s", err))
+	}
+	uid, err := hex.DecodeString(parts[2][1:])
+	if err != nil {
+		return Card{}, syntaxError(s, fmt.Sprintf("V: %s", err))
+	}
+	if length > len(uid) {
+		return Card{}, syntaxError(s, fmt.Sprintf("L is %d but V has %d bytes", length, len(uid)))
+	}
+	return Card{Reader: parts[0], Length: length, UID: uid}, nil
+}
+
+// DecodeDeviceError decodes a DeviceError.
+func DecodeDeviceError(s string) (DeviceError, error) {
+	if !strings.HasPrefix(s, " E") {
+		return DeviceError{}, syntaxError(s, "expected \" E\"")
+	}
+	return DeviceError{Message: s[2:]}, nil
+}
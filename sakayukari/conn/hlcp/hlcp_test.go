@@ -0,0 +1,150 @@
+package hlcp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRoundTrip(t *testing.T) {
+	cases := []struct {
+		m      Message
+		s      string
+		decode func(s string) (Message, error)
+	}{
+		{Identify{}, "I", DecodeRequest},
+		{ListSensors{}, "J", DecodeRequest},
+		{Change{Line: "A", Direction: true, Power: 100}, "CAAN100", DecodeRequest},
+		{Change{Line: "Z", Brake: true, Power: 0}, "CZBY000", DecodeRequest},
+		{Switch{Line: "B", Direction: true, Power: 255, Duration: 99999 * time.Millisecond, BrakeAfter: true}, "SBAN255T99999Y", DecodeRequest},
+		{Switch{Line: "C", Brake: true, Power: 7, Duration: 500 * time.Millisecond}, "SCBY007T00500N", DecodeRequest},
+		{Ping{Timeout: 2 * time.Second}, "P02000", DecodeRequest},
+		{Pong{Monotonic: 1234}, " PT1234", DecodeLineReport},
+		{Change{Line: "A", Power: 10, Seq: 42}, "CABN010#0042", DecodeRequest},
+		{Switch{Line: "A", Power: 255, Duration: 500 * time.Millisecond, Seq: 9999}, "SABN255T00500N#9999", DecodeRequest},
+		{Id{Id: "soyuu-kdss/v4/peach"}, " Isoyuu-kdss/v4/peach", func(s string) (Message, error) { return DecodeId(s) }},
+		{Id{Id: "soyuu-kdss/v4/peach", Capabilities: []string{CapAck}}, " Isoyuu-kdss/v4/peach +ack", func(s string) (Message, error) { return DecodeId(s) }},
+		{Id{Id: "soyuu-breakbeam/itsybitsy0/0", Sensors: []Sensor{{"A", 0}, {"B", 248000}}}, " Isoyuu-breakbeam/itsybitsy0/0;JAP0 JBP248000", func(s string) (Message, error) { return DecodeId(s) }},
+		{Current{Values: []Value{{"A", true}, {"B", false}, {"C", true}, {"D", false}}, Monotonic: 838942}, " DCA1B0C1D0T838942", DecodeLineReport},
+		{Short{Line: "A", Monotonic: 16387}, " DSLAT16387", DecodeLineReport},
+		{Milliamps{Values: []Reading{{"A", 120}, {"B", 0}, {"T", 7}}, Monotonic: 838942}, " DIA120 B0 T7 T838942", DecodeLineReport},
+		{Milliamps{Values: []Reading{}, Monotonic: 1}, " DIT1", DecodeLineReport},
+		{Ack{Seq: 42}, " A0042", DecodeLineReport},
+		{Nack{Seq: 42, Reason: "overcurrent"}, " X0042 overcurrent", DecodeLineReport},
+		{Seen{Values: []Value{{"A", true}, {"B", true}, {"C", true}}, Monotonic: 838942}, " DA1B1C1T838942", func(s string) (Message, error) { return DecodeSeen(s) }},
+		{Card{Reader: "card1", Length: 4, UID: []byte{0xde, 0xad, 0xbe, 0xef}}, " DNcard1 L4 VDEADBEEF", func(s string) (Message, error) { return DecodeCard(s) }},
+		{DeviceError{Message: "unknown kind 68"}, " Eunknown kind 68", func(s string) (Message, error) { return DecodeDeviceError(s) }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.s, func(t *testing.T) {
+			s, err := Encode(tc.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s != tc.s {
+				t.Fatalf("encode: got %q, want %q", s, tc.s)
+			}
+			m, err := tc.decode(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.m, m); diff != "" {
+				t.Fatalf("decode (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	encodes := []struct {
+		m   Message
+		err error
+	}{
+		{Change{Line: "a"}, ErrLine},
+		{Change{Line: "AB"}, ErrLine},
+		{Switch{Line: "A", Duration: 100000 * time.Millisecond}, ErrDuration},
+		{Switch{Line: "A", Duration: -time.Millisecond}, ErrDuration},
+		{Switch{Line: "A", Duration: 1500 * time.Microsecond}, ErrDuration},
+		{Short{Line: ""}, ErrLine},
+		{Id{Id: "a;b"}, ErrSyntax},
+		{Change{Line: "A", Seq: 10000}, ErrSeq},
+		{Ack{}, ErrSeq},
+		{Ping{Timeout: 100 * time.Second}, ErrDuration},
+		{Milliamps{Values: []Reading{{"A", -1}}}, ErrCurrent},
+	}
+	for _, tc := range encodes {
+		_, err := Encode(tc.m)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("encode %#v: got %v, want %v", tc.m, err, tc.err)
+		}
+	}
+
+	decodes := []struct {
+		s   string
+		err error
+	}{
+		{"CaAN100", ErrLine},
+		{"CAAN256", ErrPower},
+		{"CAAN1x0", ErrPower},
+		{"CACN100", ErrSyntax},
+		{"CAAN10", ErrSyntax},
+		{"SAAN100T0050Y", ErrSyntax},
+		{"SAAN100T0050xY", ErrDuration},
+		{"SAAN100X00500Y", ErrSyntax},
+		{"Q", ErrSyntax},
+		{"I1", ErrSyntax},
+		{"P2000", ErrSyntax},
+		{"P0200x", ErrDuration},
+		{"CAAN100#0000", ErrSeq},
+		{"CAAN100#00x1", ErrSeq},
+		{"CAAN100_0001", ErrSyntax},
+	}
+	for _, tc := range decodes {
+		_, err := DecodeRequest(tc.s)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("decode %q: got %v, want %v", tc.s, err, tc.err)
+		}
+		var herr *Error
+		if errors.As(err, &herr) && herr.Message != tc.s {
+			t.Errorf("decode %q: error has message %q", tc.s, herr.Message)
+		}
+	}
+
+	reports := []struct {
+		s   string
+		err error
+	}{
+		{" DCA2T1", ErrSyntax},
+		{" DCa1T1", ErrLine},
+		{" DCA1", ErrSyntax},
+		{" DCA1Tx", ErrSyntax},
+		{" DSLaT1", ErrLine},
+		{" Ohello", ErrSyntax},
+		{" DIA T1", ErrLine},
+		{" DIA-1 T1", ErrCurrent},
+		{" DIA1 B2", ErrSyntax},
+		{" PTx", ErrSyntax},
+		{" A42", ErrSeq},
+		{" X0000 lost", ErrSeq},
+	}
+	for _, tc := range reports {
+		_, err := DecodeLineReport(tc.s)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("decode %q: got %v, want %v", tc.s, err, tc.err)
+		}
+	}
+}
+
+func TestDecodeCardPadded(t *testing.T) {
+	// the rfid firmware always sends 7 bytes
+	got, err := DecodeCard(" DNcard1 L4 VDEADBEEF000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Card{Reader: "card1", Length: 4, UID: []byte{0xde, 0xad, 0xbe, 0xef, 0, 0, 0}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("(-want +got):\n%s", diff)
+	}
+}
@@ -7,15 +7,40 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/conn/hlcp"
 )
 
 type handlerLine struct{}
 
+// ackTimeout is how long to wait for a device to acknowledge a command, before sending it again.
+const ackTimeout = 500 * time.Millisecond
+
+// maxAttempts is how many times a command is sent before giving up.
+const maxAttempts = 3
+
 type lineState struct {
 	fileLock    sync.Mutex
 	latestLines map[LineName]ReqLine
+	// ack is whether the device acknowledges commands (see hlcp.CapAck).
+	ack         bool
+	seq         int
+	pendingLock sync.Mutex
+	// pending has a channel for each command waiting for an acknowledgement, which receives nil (Ack) or an error (Nack).
+	pending  map[int]chan error
+	pongLock sync.Mutex
+	lastPong time.Time
+	// forget makes latestLines be forgotten, as the device may have turned off lines by itself (see heartbeat).
+	forget atomic.Bool
+}
+
+// request is a ReqLine or ReqSwitch.
+type request interface {
+	fmt.Stringer
+	message(seq int) (hlcp.Message, error)
 }
 
 func (_ handlerLine) String() string {
@@ -24,41 +49,46 @@ func (_ handlerLine) String() string {
 
 func (_ handlerLine) HandleConn(a Actor, c *Conn) {
 	reader := bufio.NewReader(c.F)
-	if c.Id.Type != "soyuu-kdss" {
-		_, err := fmt.Fprint(c.F, "f090gD087")
-		if err != nil {
-			log.Printf("%s: f090gD087: write line: %s", c.Path, err)
-			return
-		}
-	}
 	state := new(lineState)
 	state.latestLines = map[LineName]ReqLine{}
+	state.ack = c.Has(hlcp.CapAck)
+	state.pending = map[int]chan error{}
+	state.lastPong = c.Heartbeat.clk().Now()
+	stopped := make(chan struct{})
+	// fail publishes cf, unless the actor is stopped (as then its outputs are not received anymore).
+	fail := func(cf ValCommandFailed) {
+		select {
+		case a.OutputCh <- Diffuse1{Value: cf}:
+		case <-c.stopped:
+		case <-c.inputDone:
+		}
+	}
 	go func() {
+		defer close(stopped)
+		defer state.shutdown(a, c)
 		for v := range a.InputCh {
 			switch req := v.Value.(type) {
 			case ReqLine:
+				if state.forget.Swap(false) {
+					state.latestLines = map[LineName]ReqLine{}
+				}
 				latest, ok := state.latestLines[req.Line]
 				if ok && latest == req {
 					continue
 				}
 				log.Printf("ReqLine %s %s", c.Id, req)
 				var err error
-				func() {
-					state.fileLock.Lock()
-					defer state.fileLock.Unlock()
-					if latest.Direction != req.Direction {
-						req2 := req
-						req2.Power = 0
-						_, err = fmt.Fprintf(c.F, "%s\n", req2.String())
-					}
-					_, err = fmt.Fprintf(c.F, "%s\n", req.String())
-					b := make([]byte, 64000)
-					b[0] = '_'
-					b[len(b)-1] = '\n'
-					_, err = c.F.Write(b)
-				}()
+				if latest.Direction != req.Direction {
+					req2 := req
+					req2.Power = 0
+					err = state.commit(c, req2)
+				}
+				if err == nil {
+					err = state.commit(c, req)
+				}
 				if err != nil {
 					log.Printf("commit %s: %s", req, err)
+					fail(ValCommandFailed{ReqLine: &req, Err: err.Error()})
 				} else {
 					state.latestLines[req.Line] = req
 				}
@@ -68,75 +98,199 @@ func (_ handlerLine) HandleConn(a Actor, c *Conn) {
 				//}
 			case ReqSwitch:
 				log.Printf("ReqSwitch %s %s", c.Id, req)
-				var err error
-				func() {
-					state.fileLock.Lock()
-					defer state.fileLock.Unlock()
-					_, err = fmt.Fprintf(c.F, "%s\n", req.String())
-					b := make([]byte, 64000)
-					b[0] = '_'
-					b[len(b)-1] = '\n'
-					_, err = c.F.Write(b)
-				}()
+				err := state.commit(c, req)
 				if err != nil {
 					log.Printf("commit %s: %s", req, err)
+					fail(ValCommandFailed{ReqSwitch: &req, Err: err.Error()})
 				}
 			default:
 				log.Printf("unknown type %T", req)
 			}
 		}
 	}()
+	if c.Has(hlcp.CapHeartbeat) {
+		go state.heartbeat(a, c, stopped)
+	}
+	if c.Id.Type != "soyuu-kdss" {
+		var err error
+		func() {
+			state.fileLock.Lock()
+			defer state.fileLock.Unlock()
+			_, err = fmt.Fprint(c.F, "f090gD087")
+			if err != nil {
+				return
+			}
+			err = flush(c.F)
+		}()
+		if err != nil {
+			log.Printf("%s: f090gD087: write line: %s", c.Path, err)
+			return
+		}
+	}
 	for {
 		lineRaw, err := reader.ReadString('\n')
 		if err != nil {
-			if err != io.EOF {
+			select {
+			case <-stopped:
+			default:
 				log.Printf("%s: read line: %s", c.Path, err)
 			}
+			return
+		}
+		if !strings.HasPrefix(lineRaw, " D") && !strings.HasPrefix(lineRaw, " A") && !strings.HasPrefix(lineRaw, " X") && !strings.HasPrefix(lineRaw, " P") {
 			continue
 		}
-		if !strings.HasPrefix(lineRaw, " D") {
+		m, err := hlcp.DecodeLineReport(strings.TrimRight(lineRaw, "\r\n"))
+		if err != nil {
+			log.Printf("%s: %s", c.Path, err)
 			continue
 		}
-		line := lineRaw[2:]
-		switch line[0] {
-		case 'C':
-			line = line[1:]
-			values, monotonic, err := parse(line)
-			if err != nil {
-				log.Printf("parse C: %s", err)
-				continue
-			}
-			_ = monotonic
-			v := ValCurrent{Values: make([]ValCurrentInner, 0, 4)}
-			// NOTE: monotonic is in µs, not ms!
-			for line, flow := range values {
+		switch m := m.(type) {
+		case hlcp.Current:
+			v := ValCurrent{Values: make([]ValCurrentInner, 0, len(m.Values))}
+			for _, value := range m.Values {
 				v.Values = append(v.Values, ValCurrentInner{
-					Line: line,
-					Flow: flow,
+					Line: value.Name,
+					Flow: value.Value,
 				})
 			}
 			log.Printf("diffuse %s", v)
 			a.OutputCh <- Diffuse1{Value: v}
 			// log.Printf("diffuse DONE %s", v)
-		case 'S':
-			// example: " DSLAT16387"
-			if line[1] != 'L' {
-				log.Print("parse S: expected L")
-				continue
-			}
-			target := line[2]
-			_, monotonic, err := parse(line[3:])
-			if err != nil {
-				log.Printf("parse C: T: %s", err)
-				continue
+		case hlcp.Milliamps:
+			v := ValCurrent{Values: make([]ValCurrentInner, 0, len(m.Values))}
+			for _, r := range m.Values {
+				v.Values = append(v.Values, ValCurrentInner{
+					Line:      r.Name,
+					Flow:      r.Milliamps > c.Currents.threshold(r.Name),
+					Milliamps: r.Milliamps,
+					Measured:  true,
+				})
 			}
-			v := ValShortNotify{Line: LineName(target), Monotonic: monotonic}
+			log.Printf("diffuse %s", v)
+			a.OutputCh <- Diffuse1{Value: v}
+		case hlcp.Short:
+			v := ValShortNotify{Line: m.Line, Monotonic: m.Monotonic}
 			log.Printf("diffuseS %s", v)
 			a.OutputCh <- Diffuse1{Value: v}
+		case hlcp.Pong:
+			state.pong(c.Heartbeat.clk().Now())
+		case hlcp.Ack:
+			state.acknowledged(m.Seq, nil)
+		case hlcp.Nack:
+			state.acknowledged(m.Seq, fmt.Errorf("rejected by device: %s", m.Reason))
 		}
 	}
 }
 
+// writeReq writes req with sequence number seq (0 for none) to c.F in a single write, and flushes it.
+func writeReq(c *Conn, req request, seq int) error {
+	m, err := req.message(seq)
+	if err != nil {
+		return err
+	}
+	return writeMessage(c, m)
+}
+
+// writeMessage writes m to c.F in a single write, and flushes it.
+func writeMessage(c *Conn, m hlcp.Message) error {
+	s, err := hlcp.Encode(m)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(c.F, s+"\n")
+	if err != nil {
+		return err
+	}
+	return flush(c.F)
+}
+
+// writeMessage writes m.
+func (state *lineState) writeMessage(c *Conn, m hlcp.Message) error {
+	state.fileLock.Lock()
+	defer state.fileLock.Unlock()
+	return writeMessage(c, m)
+}
+
+// write writes req.
+func (state *lineState) write(c *Conn, req request, seq int) error {
+	state.fileLock.Lock()
+	defer state.fileLock.Unlock()
+	return writeReq(c, req, seq)
+}
+
+// commit writes req, and if the device acknowledges commands, waits for it to be acknowledged, sending it again up to maxAttempts times.
+func (state *lineState) commit(c *Conn, req request) error {
+	if !state.ack {
+		return state.write(c, req, 0)
+	}
+	state.pendingLock.Lock()
+	state.seq = state.seq%hlcp.MaxSeq + 1
+	seq := state.seq
+	result := make(chan error, 1)
+	state.pending[seq] = result
+	state.pendingLock.Unlock()
+	defer func() {
+		state.pendingLock.Lock()
+		defer state.pendingLock.Unlock()
+		delete(state.pending, seq)
+	}()
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err := state.write(c, req, seq)
+		if err != nil {
+			return err
+		}
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(ackTimeout):
+			log.Printf("%s: %s (#%04d) not acknowledged (attempt %d of %d)", c.Path, req, seq, attempt, maxAttempts)
+		}
+	}
+	return fmt.Errorf("not acknowledged after %d attempts", maxAttempts)
+}
+
+// acknowledged reports the result of the command with sequence number seq.
+func (state *lineState) acknowledged(seq int, err error) {
+	state.pendingLock.Lock()
+	defer state.pendingLock.Unlock()
+	result, ok := state.pending[seq]
+	if !ok {
+		// e.g. acknowledged after we gave up, or acknowledged twice as it was sent again
+		return
+	}
+	select {
+	case result <- err:
+	default:
+	}
+}
+
+// shutdown turns off all lines that were turned on, and then closes c.F (if possible) and a.Done.
+func (state *lineState) shutdown(a Actor, c *Conn) {
+	state.fileLock.Lock()
+	defer state.fileLock.Unlock()
+	for _, latest := range state.latestLines {
+		if latest.Power == 0 {
+			continue
+		}
+		req := ReqLine{Line: latest.Line, Brake: true, Direction: latest.Direction, Power: 0}
+		log.Printf("shutdown: ReqLine %s %s", c.Id, req)
+		err := writeReq(c, req, 0)
+		if err != nil {
+			log.Printf("shutdown: commit %s: %s", req, err)
+		}
+	}
+	if closer, ok := c.F.(io.Closer); ok {
+		err := closer.Close()
+		if err != nil {
+			log.Printf("%s: close: %s", c.Path, err)
+		}
+	}
+	if a.Done != nil {
+		close(a.Done)
+	}
+}
+
 func (_ handlerLine) NewBlankActor() Actor {
 	return Actor{
 		Comment:  "blank handlerLine",
@@ -147,5 +301,6 @@ func (_ handlerLine) NewBlankActor() Actor {
 			LinearInput: true,
 			Output:      true,
 		},
+		Done: make(chan struct{}),
 	}
 }
@@ -0,0 +1,187 @@
+package conn
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/clock"
+	"nyiyui.ca/hato/sakayukari/conn/emulator"
+	"nyiyui.ca/hato/sakayukari/conn/hlcp"
+)
+
+// waitLine waits until the line of d is want.
+func waitLine(t *testing.T, d *emulator.Device, line string, want emulator.LineState) {
+	t.Helper()
+	for i := 0; d.Line(line) != want; i++ {
+		if i == 100 {
+			t.Fatalf("line %s: got %#v, want %#v", line, d.Line(line), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandlerLine(t *testing.T) {
+	v := clock.NewVirtual(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := emulator.New(emulator.Conf{
+		Id:    "soyuu-line/v2/test",
+		Clock: v,
+		OnCommand: func(d *emulator.Device, cmd emulator.Command) {
+			d.ReportCurrent(map[string]bool{cmd.Line: cmd.Power > 0})
+		},
+	})
+	a := handlerLine{}.NewBlankActor()
+	c := &Conn{Id: ParseId("soyuu-line/v2/test"), Path: "/dev/test0", F: d.Pipe()}
+	go handlerLine{}.HandleConn(a, c)
+
+	a.InputCh <- Diffuse1{Value: ReqLine{Line: "A", Power: 100}}
+	waitLine(t, d, "A", emulator.LineState{Power: 100})
+	if diff := cmp.Diff(ValCurrent{Values: []ValCurrentInner{{Line: "A", Flow: true}}}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("current (-want +got):\n%s", diff)
+	}
+
+	a.InputCh <- Diffuse1{Value: ReqSwitch{Line: "B", Direction: true, Power: 255, Duration: 500}}
+	waitLine(t, d, "B", emulator.LineState{Direction: true, Power: 255})
+	<-a.OutputCh // current
+	v.Advance(500 * time.Millisecond)
+	if diff := cmp.Diff(ValShortNotify{Line: "B", Monotonic: 500}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("short (-want +got):\n%s", diff)
+	}
+
+	close(a.InputCh)
+	waitLine(t, d, "A", emulator.LineState{Brake: true})
+	<-a.Done
+}
+
+func TestHandlerMilliamps(t *testing.T) {
+	d := emulator.New(emulator.Conf{Id: "soyuu-kdss/v4/test"})
+	a := handlerLine{}.NewBlankActor()
+	c := &Conn{
+		Id:       ParseId("soyuu-kdss/v4/test"),
+		Path:     "/dev/test0",
+		F:        d.Pipe(),
+		Currents: CurrentConf{Thresholds: map[LineName]int{"A": 50}},
+	}
+	go handlerLine{}.HandleConn(a, c)
+
+	go d.ReportMilliamps(map[string]int{"A": 40, "B": 30, "C": 0})
+	want := ValCurrent{Values: []ValCurrentInner{
+		{Line: "A", Flow: false, Milliamps: 40, Measured: true},
+		{Line: "B", Flow: true, Milliamps: 30, Measured: true},
+		{Line: "C", Flow: false, Milliamps: 0, Measured: true},
+	}}
+	if diff := cmp.Diff(want, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("current (-want +got):\n%s", diff)
+	}
+	close(a.InputCh)
+	<-a.Done
+}
+
+func TestHandlerLineAck(t *testing.T) {
+	var lock sync.Mutex
+	lost := map[string]int{}
+	d := emulator.New(emulator.Conf{
+		Id:  "soyuu-kdss/v4/test",
+		Ack: true,
+		Lose: func(cmd emulator.Command) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			lost[cmd.Line]++
+			// A is lost once, and D always
+			return (cmd.Line == "A" && lost[cmd.Line] == 1) || cmd.Line == "D"
+		},
+		Reject: func(cmd emulator.Command) string {
+			if cmd.Line == "C" {
+				return "overcurrent"
+			}
+			return ""
+		},
+	})
+	c, err := attach("/dev/test0", d.Pipe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Has(hlcp.CapAck) {
+		t.Fatalf("capabilities: %#v", c.Capabilities)
+	}
+	a := handlerLine{}.NewBlankActor()
+	go handlerLine{}.HandleConn(a, c)
+
+	// sent again after the first attempt is lost
+	a.InputCh <- Diffuse1{Value: ReqLine{Line: "A", Power: 100}}
+	waitLine(t, d, "A", emulator.LineState{Power: 100})
+
+	reqC := ReqSwitch{Line: "C", Power: 255, Duration: 500}
+	a.InputCh <- Diffuse1{Value: reqC}
+	want := ValCommandFailed{ReqSwitch: &reqC, Err: "rejected by device: overcurrent"}
+	if diff := cmp.Diff(want, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("rejected (-want +got):\n%s", diff)
+	}
+
+	reqD := ReqLine{Line: "D", Power: 100}
+	a.InputCh <- Diffuse1{Value: reqD}
+	want = ValCommandFailed{ReqLine: &reqD, Err: "not acknowledged after 3 attempts"}
+	if diff := cmp.Diff(want, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("lost (-want +got):\n%s", diff)
+	}
+	lock.Lock()
+	if lost["D"] != maxAttempts {
+		t.Fatalf("D sent %d times", lost["D"])
+	}
+	lock.Unlock()
+
+	close(a.InputCh)
+	<-a.Done
+}
+
+func TestHandlerLineStopped(t *testing.T) {
+	d := emulator.New(emulator.Conf{
+		Id:  "soyuu-kdss/v4/test",
+		Ack: true,
+		Reject: func(cmd emulator.Command) string {
+			if cmd.Line == "C" {
+				return "overcurrent"
+			}
+			return ""
+		},
+	})
+	c, err := attach("/dev/test0", d.Pipe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	c.stopped = stopped
+	a := handlerLine{}.NewBlankActor()
+	go handlerLine{}.HandleConn(a, c)
+
+	a.InputCh <- Diffuse1{Value: ReqLine{Line: "A", Power: 100}}
+	waitLine(t, d, "A", emulator.LineState{Power: 100})
+	// e.g. the runtime shut down, so nothing receives the ValCommandFailed
+	close(stopped)
+	a.InputCh <- Diffuse1{Value: ReqSwitch{Line: "C", Power: 255, Duration: 500}}
+	close(a.InputCh)
+	select {
+	case <-a.Done:
+	case <-time.After(time.Second):
+		t.Fatal("handler blocked on publishing ValCommandFailed")
+	}
+	waitLine(t, d, "A", emulator.LineState{Brake: true})
+}
+
+func TestReqSwitchEncode(t *testing.T) {
+	s, err := ReqSwitch{Line: "A", Direction: true, Power: 100, Duration: 99999}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "SAAN100T99999N" {
+		t.Fatalf("got %q", s)
+	}
+	// used to be truncated silently
+	_, err = ReqSwitch{Line: "A", Duration: 100000}.Encode()
+	if !errors.Is(err, hlcp.ErrDuration) {
+		t.Fatalf("got %v", err)
+	}
+}
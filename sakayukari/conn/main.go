@@ -7,39 +7,73 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"time"
 
 	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/conn/hlcp"
 )
 
 func ConnActors(expected []Id) (*State, []Actor) {
 	s := new(State)
 	s.conns = map[ConnName]*Conn{}
-	s.actors = map[Id]Actor{}
+	s.slots = map[Id]*slot{}
+	s.currents = map[Id]CurrentConf{}
+	s.idBauds = map[Id]int{}
+	s.pathBauds = map[string]int{}
+	s.stopped = make(chan struct{})
 
 	as := make([]Actor, 0, len(expected))
 	for _, id := range expected {
-		handler, ok := handlers[id.Type]
+		handler, ok := lookupHandler(id.Type)
 		if !ok {
 			panic(fmt.Sprintf("no handler for type %s (%s)", id.Type, id))
 		}
 		a := handler.NewBlankActor()
 		as = append(as, a)
-		s.actors[id] = a
+		s.slots[id] = newSlot(id, a, s.stopped)
 	}
 	return s, as
 }
 
+// Handler talks to devices of a type (see RegisterHandler).
 type Handler interface {
+	// HandleConn handles c until reading from c.F fails, or a.InputCh is closed (if a has inputs).
+	// The same actor is given again if the device reconnects, except that InputCh and Done are made for each connection.
+	// If a has inputs, HandleConn must close a.Done after it stopped using c.F (after a.InputCh is closed).
 	HandleConn(a Actor, c *Conn)
+	// NewBlankActor makes the actor for a device, before it is connected.
 	NewBlankActor() Actor
 	String() string
 }
 
-var handlers = map[string]Handler{
-	"soyuu-line":      handlerLine{},
-	"soyuu-kdss":      handlerLine{},
-	"soyuu-breakbeam": handlerBreakbeam{},
-	"soyuu-rfid":      handlerRFID{},
+var (
+	handlersLock sync.RWMutex
+	handlers     = map[string]Handler{}
+)
+
+// RegisterHandler registers h for devices whose Id.Type is typ, so ConnActors can make actors for them.
+// This is usually called from an init function of the package defining the handler.
+func RegisterHandler(typ string, h Handler) {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+	if h2, ok := handlers[typ]; ok {
+		panic(fmt.Sprintf("handler for type %s already registered (%s)", typ, h2))
+	}
+	handlers[typ] = h
+}
+
+func lookupHandler(typ string) (Handler, bool) {
+	handlersLock.RLock()
+	defer handlersLock.RUnlock()
+	h, ok := handlers[typ]
+	return h, ok
+}
+
+func init() {
+	RegisterHandler("soyuu-line", handlerLine{})
+	RegisterHandler("soyuu-kdss", handlerLine{})
+	RegisterHandler("soyuu-breakbeam", handlerBreakbeam{})
+	RegisterHandler("soyuu-rfid", handlerRFID{})
 }
 
 type Path = string
@@ -50,15 +84,71 @@ type STName = string // ST = 照査点
 type State struct {
 	conns     map[ConnName]*Conn
 	connsLock sync.RWMutex
-	actors    map[Id]Actor
+	slots     map[Id]*slot
+	serial    SerialConf
+	// idBauds are the baud rates of devices that do not use serial.Baud (see SetBaud).
+	idBauds map[Id]int
+	// pathBauds are the baud rates of the devices last attached on serial ports.
+	pathBauds map[string]int
+	// network are the addresses of network devices (see SetNetworkDevices).
+	network []string
+	// currents are given to connections to line devices (see SetCurrentConf).
+	currents  map[Id]CurrentConf
+	heartbeat HeartbeatConf
+	// captureDir is where connections are captured to (see SetCaptureDir).
+	captureDir string
+	// open opens ports instead of OpenSerial if not nil (for tests).
+	open func(path string, conf SerialConf) (io.ReadWriteCloser, error)
+	// stopped is closed when Watch's ctx is done, as the actors are not run anymore.
+	stopped  chan struct{}
+	stopOnce sync.Once
 }
 
 func (s *State) Find() error { return s.find() }
 
+// SetSerialConf sets how serial ports are opened by Find.
+func (s *State) SetSerialConf(conf SerialConf) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	s.serial = conf
+}
+
 type Conn struct {
 	Id   Id
 	Path string
-	F    io.ReadWriter
+	// F is written to in whole requests (see hlcp), which are flushed if F is a Flusher.
+	F io.ReadWriter
+	// Capabilities are from the device's reply to Identify (e.g. hlcp.CapAck).
+	Capabilities []string
+	// Currents and Heartbeat are for line devices.
+	Currents  CurrentConf
+	Heartbeat HeartbeatConf
+	// stopped and inputDone are the State's and the actor's slot's (see slot), so handlers do not block on outputs nobody receives anymore.
+	stopped, inputDone <-chan struct{}
+}
+
+// Flusher is implemented by transports that buffer writes (e.g. Serial), so requests can be pushed to the device immediately.
+type Flusher interface {
+	// Flush blocks until everything written is sent to the device.
+	Flush() error
+}
+
+// flush flushes w if it is a Flusher.
+func flush(w io.Writer) error {
+	if f, ok := w.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Has returns whether the device has capability c.
+func (c *Conn) Has(capability string) bool {
+	for _, c2 := range c.Capabilities {
+		if c2 == capability {
+			return true
+		}
+	}
+	return false
 }
 
 func AbsClampPower(power int) uint8 {
@@ -80,39 +170,37 @@ type ReqSwitch struct {
 	BrakeAfter bool
 }
 
+// Encode returns r encoded in HLCP.
+func (r ReqSwitch) Encode() (string, error) {
+	m, err := r.message(0)
+	if err != nil {
+		return "", err
+	}
+	return hlcp.Encode(m)
+}
+
+// message returns r with sequence number seq (0 for none).
+func (r ReqSwitch) message(seq int) (hlcp.Message, error) {
+	if r.Duration > uint64(hlcp.MaxDuration.Milliseconds()) {
+		return nil, &hlcp.Error{Message: fmt.Sprintf("%#v", r), Err: hlcp.ErrDuration, Detail: fmt.Sprintf("%d ms", r.Duration)}
+	}
+	return hlcp.Switch{
+		Line:       r.Line,
+		Direction:  r.Direction,
+		Brake:      r.Brake,
+		Power:      r.Power,
+		Duration:   time.Duration(r.Duration) * time.Millisecond,
+		BrakeAfter: r.BrakeAfter,
+		Seq:        seq,
+	}, nil
+}
+
 func (r ReqSwitch) String() string {
-	var send [14]byte
-	// SAAN000T00000N
-	// S - switch
-	//  A - line
-	//   A - direction
-	//    N - brake
-	//     000 - power
-	//        00000 - duration (ms)
-	//             N - brake after
-	send[0] = 'S'
-	send[1] = r.Line[0]
-	if r.Direction {
-		send[2] = 'A'
-	} else {
-		send[2] = 'B'
-	}
-	if r.Brake {
-		send[3] = 'Y'
-	} else {
-		send[3] = 'N'
-	}
-	power := fmt.Sprintf("%03d", r.Power)
-	copy(send[4:], power)
-	send[7] = 'T'
-	duration := fmt.Sprintf("%05d", r.Duration)
-	copy(send[8:], duration)
-	if r.BrakeAfter {
-		send[13] = 'Y'
-	} else {
-		send[13] = 'N'
-	}
-	return string(send[:])
+	s, err := r.Encode()
+	if err != nil {
+		return fmt.Sprintf("invalid ReqSwitch (%s)", err)
+	}
+	return s
 }
 
 type ReqLine struct {
@@ -122,29 +210,29 @@ type ReqLine struct {
 	Power     uint8
 }
 
+// Encode returns r encoded in HLCP.
+func (r ReqLine) Encode() (string, error) {
+	m, _ := r.message(0)
+	return hlcp.Encode(m)
+}
+
+// message returns r with sequence number seq (0 for none).
+func (r ReqLine) message(seq int) (hlcp.Message, error) {
+	return hlcp.Change{
+		Line:      r.Line,
+		Direction: r.Direction,
+		Brake:     r.Brake,
+		Power:     r.Power,
+		Seq:       seq,
+	}, nil
+}
+
 func (r ReqLine) String() string {
-	var send [7]byte
-	// CAAN000
-	// C - change
-	//  A - line
-	//   A - direction
-	//    N - brake
-	//     000 - power
-	send[0] = 'C'
-	send[1] = r.Line[0]
-	if r.Direction {
-		send[2] = 'A'
-	} else {
-		send[2] = 'B'
-	}
-	if r.Brake {
-		send[3] = 'Y'
-	} else {
-		send[3] = 'N'
-	}
-	power := fmt.Sprintf("%03d", r.Power)
-	copy(send[4:], power)
-	return string(send[:])
+	s, err := r.Encode()
+	if err != nil {
+		return fmt.Sprintf("invalid ReqLine (%s)", err)
+	}
+	return s
 }
 
 type Id struct {
@@ -186,12 +274,40 @@ func ParseId(id string) Id {
 	return id2
 }
 
+// handleConn handles c until it is disconnected.
 func (s *State) handleConn(c *Conn) {
-	handler := handlers[c.Id.Type]
-	if handler == nil {
-		log.Printf("no handler found for %s %s", c.Path, c.Id)
+	sl, ok := s.slots[c.Id]
+	if !ok {
+		log.Printf("unexpected device %s %s; ignoring until disconnected", c.Path, c.Id)
+		io.Copy(io.Discard, c.F)
+		return
+	}
+	a, err := sl.attach(c)
+	if err != nil {
+		log.Printf("%s: %s", c.Path, err)
 		return
 	}
+	s.connsLock.RLock()
+	c.Currents = s.currents[c.Id]
+	c.Heartbeat = s.heartbeat
+	c.stopped, c.inputDone = sl.stopped, sl.pumpDone
+	captureDir := s.captureDir
+	s.connsLock.RUnlock()
+	if captureDir != "" {
+		cp, err := openCapture(captureDir, c)
+		if err != nil {
+			log.Printf("%s: capture: %s", c.Path, err)
+		} else {
+			defer cp.Close()
+			c.F = &captureConn{f: c.F, cp: cp}
+		}
+	}
+	handler, _ := lookupHandler(c.Id.Type)
 	log.Printf("handling %s %s with %s", c.Path, c.Id, handler)
-	handler.HandleConn(s.actors[c.Id], c)
+	sl.publishState(c, true)
+	handler.HandleConn(a, c)
+	log.Printf("disconnected %s %s", c.Path, c.Id)
+	if sl.detach() {
+		sl.publishState(c, false)
+	}
 }
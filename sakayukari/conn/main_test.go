@@ -0,0 +1,60 @@
+package conn
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	. "nyiyui.ca/hato/sakayukari"
+)
+
+// echoHandler publishes every line read as a Message.
+type echoHandler struct{}
+
+func (echoHandler) String() string { return "echo" }
+
+func (echoHandler) NewBlankActor() Actor {
+	return Actor{
+		Comment:  "blank echoHandler",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}
+}
+
+func (echoHandler) HandleConn(a Actor, c *Conn) {
+	reader := bufio.NewReader(c.F)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		a.OutputCh <- Diffuse1{Value: Message(strings.TrimSpace(line))}
+	}
+}
+
+func init() {
+	RegisterHandler("test-echo", echoHandler{})
+}
+
+func TestRegisterHandler(t *testing.T) {
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("duplicate registration did not panic")
+			}
+		}()
+		RegisterHandler("test-echo", echoHandler{})
+	}()
+
+	id := Id{Type: "test-echo", Variant: "v1", Instance: "0"}
+	s, as := ConnActors([]Id{id})
+	c, device, _ := fakeDevice(id, "/dev/test0")
+	go s.handleConn(c)
+	if v := (<-as[0].OutputCh).Value; v != (ValConnState{Id: id, Path: "/dev/test0", Up: true}) {
+		t.Fatalf("got %s", v)
+	}
+	device.Write([]byte("hello\n"))
+	if v := (<-as[0].OutputCh).Value; v != Message("hello") {
+		t.Fatalf("got %s", v)
+	}
+}
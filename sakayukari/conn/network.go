@@ -0,0 +1,39 @@
+package conn
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// dialTimeout is how long Find waits when connecting to a network device.
+const dialTimeout = 2 * time.Second
+
+// networkPrefix prefixes the paths of network devices (e.g. "tcp://192.0.2.1:4001").
+const networkPrefix = "tcp://"
+
+// SetNetworkDevices sets the addresses (host:port) of devices reachable over TCP, which Find connects to in addition to serial ports.
+// The other end must relay bytes as-is (e.g. ser2net in raw mode, or a WiFi serial bridge).
+func (s *State) SetNetworkDevices(addrs []string) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	s.network = addrs
+}
+
+// networkPaths returns the paths of network devices. State.connsLock must be locked at call site.
+func (s *State) networkPaths() []string {
+	paths := make([]string, 0, len(s.network))
+	for _, addr := range s.network {
+		paths = append(paths, networkPrefix+addr)
+	}
+	return paths
+}
+
+// dialNetwork connects to the network device at path, or returns ok = false if path is not of a network device.
+func dialNetwork(path string) (c net.Conn, ok bool, err error) {
+	if !strings.HasPrefix(path, networkPrefix) {
+		return nil, false, nil
+	}
+	c, err = net.DialTimeout("tcp", strings.TrimPrefix(path, networkPrefix), dialTimeout)
+	return c, true, err
+}
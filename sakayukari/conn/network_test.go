@@ -0,0 +1,69 @@
+package conn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/conn/emulator"
+)
+
+func TestNetwork(t *testing.T) {
+	id := Id{Type: "soyuu-kdss", Variant: "v4", Instance: "test"}
+	d := emulator.New(emulator.Conf{Id: id.String()})
+	// stands in for e.g. ser2net
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.Serve(c)
+		}
+	}()
+
+	s, as := ConnActors([]Id{id})
+	a := as[0]
+	s.SetNetworkDevices([]string{l.Addr().String()})
+	path := "tcp://" + l.Addr().String()
+	err = s.Find()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ValConnState{Id: id, Path: path, Up: true}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("up (-want +got):\n%s", diff)
+	}
+	a.InputCh <- Diffuse1{Value: ReqLine{Line: "A", Power: 100}}
+	waitLine(t, d, "A", emulator.LineState{Power: 100})
+
+	d.Disconnect()
+	if diff := cmp.Diff(ValConnState{Id: id, Path: path, Up: false}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("down (-want +got):\n%s", diff)
+	}
+	// Find skips paths until their connections are forgotten
+	for {
+		s.connsLock.RLock()
+		_, ok := s.conns[path]
+		s.connsLock.RUnlock()
+		if !ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = s.Find()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ValConnState{Id: id, Path: path, Up: true}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("up again (-want +got):\n%s", diff)
+	}
+	a.InputCh <- Diffuse1{Value: ReqLine{Line: "A", Power: 50}}
+	waitLine(t, d, "A", emulator.LineState{Power: 50})
+}
@@ -0,0 +1,58 @@
+package conn
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"nyiyui.ca/hato/sakayukari/clock"
+	"nyiyui.ca/hato/sakayukari/conn/hlcp"
+)
+
+// Replay returns a Conn for a fake device that sends the bytes read in records (see ReadCapture) with the same intervals as when captured, measured on clk (clock.Real if nil).
+// Writes to the Conn are discarded, so the replay does not depend on what the host sends.
+// Reading from the Conn fails with io.EOF after the last record.
+func Replay(records []Record, path string, clk clock.Clock) (*Conn, error) {
+	if len(records) == 0 || records[0].Kind != RecordIdentify {
+		return nil, errors.New("capture does not start with an identify record")
+	}
+	id, err := hlcp.DecodeId(strings.TrimRight(string(records[0].Data), "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	clk = clock.Or(clk)
+	r, w := io.Pipe()
+	go func() {
+		prev := records[0].Time
+		for _, rec := range records[1:] {
+			if rec.Kind != RecordRead {
+				continue
+			}
+			clk.Sleep(rec.Time.Sub(prev))
+			prev = rec.Time
+			_, err := w.Write(rec.Data)
+			if err != nil {
+				// closed by the host
+				return
+			}
+		}
+		w.Close()
+	}()
+	return &Conn{
+		Id:           ParseId(id.Id),
+		Path:         path,
+		F:            &replayConn{r: r},
+		Capabilities: id.Capabilities,
+	}, nil
+}
+
+type replayConn struct {
+	r *io.PipeReader
+}
+
+func (c *replayConn) Read(p []byte) (n int, err error)  { return c.r.Read(p) }
+func (c *replayConn) Write(p []byte) (n int, err error) { return len(p), nil }
+func (c *replayConn) Close() error                      { return c.r.Close() }
+
+// HandleConn handles c (e.g. from Replay) as if it was found by Find, until it is disconnected.
+func (s *State) HandleConn(c *Conn) { s.handleConn(c) }
@@ -0,0 +1,30 @@
+package conn
+
+import (
+	"bytes"
+	"testing"
+
+	"nyiyui.ca/hato/sakayukari/conn/emulator"
+)
+
+func TestHandlerRFID(t *testing.T) {
+	d := emulator.New(emulator.Conf{Id: "soyuu-rfid/v2/0"})
+	a := handlerRFID{}.NewBlankActor()
+	c := &Conn{Id: ParseId("soyuu-rfid/v2/0"), Path: "/dev/test0", F: d.Pipe()}
+	go handlerRFID{}.HandleConn(a, c)
+
+	// 4-byte UIDs are padded to 7 bytes by the firmware
+	uid := []byte{0xde, 0xad, 0xbe, 0xef}
+	d.ReportCard(uid)
+	v := (<-a.OutputCh).Value.(ValSeen)
+	if len(v.ID) != 1 || !bytes.Equal(v.ID[0].RFID, []byte{0xde, 0xad, 0xbe, 0xef, 0, 0, 0}) {
+		t.Fatalf("got %#v", v.ID)
+	}
+	// the same card is only reported once
+	d.ReportCard(uid)
+	d.ReportCard([]byte{1, 2, 3, 4})
+	v = (<-a.OutputCh).Value.(ValSeen)
+	if !bytes.Equal(v.ID[0].RFID, []byte{1, 2, 3, 4, 0, 0, 0}) {
+		t.Fatalf("got %#v", v.ID)
+	}
+}
@@ -0,0 +1,73 @@
+package conn
+
+import (
+	"sort"
+	"time"
+)
+
+// DefaultBaud is the baud rate used when SerialConf.Baud is 0. Most soyuu firmware uses this rate; the rfid and line2 firmware use 115200 (see State.SetBaud).
+const DefaultBaud = 9600
+
+// DefaultResetWait is used when SerialConf.ResetWait is 0.
+const DefaultResetWait = 1 * time.Second
+
+// SerialConf configures how serial ports are opened.
+type SerialConf struct {
+	// Baud is the baud rate of devices without their own (see State.SetBaud). If 0, DefaultBaud is used.
+	Baud int
+	// ResetDTR drops and raises DTR after opening the port, which resets Arduinos.
+	ResetDTR bool
+	// ResetWait is how long to wait after opening the port (and resetting), so the device's bootloader can finish. If 0, DefaultResetWait is used; if negative, there is no wait.
+	ResetWait time.Duration
+}
+
+func (c SerialConf) baud() int {
+	if c.Baud == 0 {
+		return DefaultBaud
+	}
+	return c.Baud
+}
+
+func (c SerialConf) resetWait() time.Duration {
+	if c.ResetWait == 0 {
+		return DefaultResetWait
+	}
+	if c.ResetWait < 0 {
+		return 0
+	}
+	return c.ResetWait
+}
+
+// SetBaud sets the baud rate of the device id, if it is not SerialConf.Baud.
+func (s *State) SetBaud(id Id, baud int) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	s.idBauds[id] = baud
+}
+
+// bauds returns the baud rates to open the serial port at path with, until a device replies: the rate of the device last on path, SerialConf.Baud, then the rates set by SetBaud.
+// State.connsLock must be locked at call site.
+func (s *State) bauds(path string) []int {
+	bauds := []int{}
+	add := func(baud int) {
+		for _, b := range bauds {
+			if b == baud {
+				return
+			}
+		}
+		bauds = append(bauds, baud)
+	}
+	if baud, ok := s.pathBauds[path]; ok {
+		add(baud)
+	}
+	add(s.serial.baud())
+	ids := make([]Id, 0, len(s.idBauds))
+	for id := range s.idBauds {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	for _, id := range ids {
+		add(s.idBauds[id])
+	}
+	return bauds
+}
@@ -0,0 +1,114 @@
+package conn
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var baudRates = map[int]uint32{
+	1200:    unix.B1200,
+	2400:    unix.B2400,
+	4800:    unix.B4800,
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	500000:  unix.B500000,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+}
+
+// Serial is a serial port opened in raw mode.
+// Close unblocks pending reads, and Read and Write support deadlines.
+type Serial struct {
+	*os.File
+}
+
+// Flush waits until everything written is transmitted (like tcdrain(3)).
+func (s *Serial) Flush() error {
+	rc, err := s.SyscallConn()
+	if err != nil {
+		return err
+	}
+	err2 := rc.Control(func(fd uintptr) {
+		err = unix.IoctlSetInt(int(fd), unix.TCSBRK, 1)
+	})
+	if err2 != nil {
+		return err2
+	}
+	if err != nil {
+		return &os.PathError{Op: "flush", Path: s.Name(), Err: err}
+	}
+	return nil
+}
+
+// OpenSerial opens the serial port at path in raw mode (8N1, no flow control).
+func OpenSerial(path string, conf SerialConf) (*Serial, error) {
+	speed, ok := baudRates[conf.baud()]
+	if !ok {
+		return nil, fmt.Errorf("open %s: unsupported baud rate %d", path, conf.baud())
+	}
+	// O_NONBLOCK so os.NewFile uses the poller (for Close and deadlines), and so opening does not wait for carrier detect.
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	err = setRaw(fd, speed)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	if conf.ResetDTR {
+		err = resetDTR(fd)
+		if err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("open %s: reset: %w", path, err)
+		}
+	}
+	time.Sleep(conf.resetWait())
+	// discard anything the device sent while booting
+	err = unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIOFLUSH)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("open %s: flush: %w", path, err)
+	}
+	return &Serial{os.NewFile(uintptr(fd), path)}, nil
+}
+
+func setRaw(fd int, speed uint32) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return fmt.Errorf("get termios: %w", err)
+	}
+	// same as cfmakeraw(3)
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+	t.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | unix.HUPCL | speed
+	t.Ispeed = speed
+	t.Ospeed = speed
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	err = unix.IoctlSetTermios(fd, unix.TCSETS, t)
+	if err != nil {
+		return fmt.Errorf("set termios: %w", err)
+	}
+	return nil
+}
+
+// resetDTR drops DTR then raises it again, which resets Arduinos (through the capacitor on the reset line, or the USB CDC driver).
+func resetDTR(fd int) error {
+	err := unix.IoctlSetPointerInt(fd, unix.TIOCMBIC, unix.TIOCM_DTR)
+	if err != nil {
+		return err
+	}
+	time.Sleep(100 * time.Millisecond)
+	return unix.IoctlSetPointerInt(fd, unix.TIOCMBIS, unix.TIOCM_DTR)
+}
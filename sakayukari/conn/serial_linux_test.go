@@ -0,0 +1,100 @@
+package conn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPty returns the master of a new pty, and the path of its slave.
+func openPty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("no ptys: %s", err)
+	}
+	t.Cleanup(func() { master.Close() })
+	err = unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestSerialAttach(t *testing.T) {
+	master, path := openPty(t)
+	go func() {
+		// pretend to be a device
+		r := bufio.NewReader(master)
+		line, err := r.ReadString('\n')
+		if err != nil || line != "I\n" {
+			t.Errorf("query: %q %s", line, err)
+			return
+		}
+		master.Write([]byte("booting\r\n Isoyuu-line/v1/test\r\nhello\r\n"))
+	}()
+
+	f, err := OpenSerial(path, SerialConf{Baud: 115200, ResetWait: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	c, err := attach(path, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Id{Type: "soyuu-line", Variant: "v1", Instance: "test"}
+	if c.Id != want {
+		t.Fatalf("id: got %s, want %s", c.Id, want)
+	}
+	line, err := bufio.NewReader(c.F).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\r\n" {
+		t.Fatalf("line after id: %q", line)
+	}
+
+	_, err = c.F.Write([]byte("C\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.F.(Flusher).Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 2)
+	_, err = io.ReadFull(master, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "C\n" {
+		t.Fatalf("written: %q", got)
+	}
+
+	// Close unblocks pending reads, so handlers can stop.
+	done := make(chan error)
+	go func() {
+		_, err := c.F.Read(make([]byte, 1))
+		done <- err
+	}()
+	c.F.(io.Closer).Close()
+	if err := <-done; err == nil {
+		t.Fatal("read after close succeeded")
+	}
+}
+
+func TestSerialBaud(t *testing.T) {
+	_, path := openPty(t)
+	_, err := OpenSerial(path, SerialConf{Baud: 12345, ResetWait: -1})
+	if err == nil {
+		t.Fatal("unsupported baud rate accepted")
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package conn
+
+import (
+	"errors"
+	"os"
+)
+
+// Serial is a serial port opened in raw mode.
+type Serial struct {
+	*os.File
+}
+
+// OpenSerial is only supported on Linux.
+func OpenSerial(path string, conf SerialConf) (*Serial, error) {
+	return nil, errors.New("serial ports are only supported on linux")
+}
+
+// Flush is only supported on Linux.
+func (s *Serial) Flush() error {
+	return errors.New("serial ports are only supported on linux")
+}
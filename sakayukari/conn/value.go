@@ -6,8 +6,21 @@ import (
 	"time"
 
 	"golang.org/x/exp/slices"
+	. "nyiyui.ca/hato/sakayukari"
 )
 
+func init() {
+	RegisterValue("conn.ValAttitude", ValAttitude{})
+	RegisterValue("conn.ValSeen", ValSeen{})
+	RegisterValue("conn.ValCurrent", ValCurrent{})
+	RegisterValue("conn.ValShortNotify", ValShortNotify{})
+	RegisterValue("conn.ReqLine", ReqLine{})
+	RegisterValue("conn.ReqSwitch", ReqSwitch{})
+	RegisterValue("conn.ValConnState", ValConnState{})
+	RegisterValue("conn.ValCommandFailed", ValCommandFailed{})
+	RegisterValue("conn.ValHeartbeat", ValHeartbeat{})
+}
+
 // Integral length in micrometres.
 type Length = int64
 
@@ -97,13 +110,20 @@ func (v ValCurrent) String() string {
 			flow = '1'
 		}
 		fmt.Fprintf(b, " %s%c", val.Line, flow)
+		if val.Measured {
+			fmt.Fprintf(b, "(%dmA)", val.Milliamps)
+		}
 	}
 	return b.String()
 }
 
 type ValCurrentInner struct {
 	Line LineName
+	// Flow is whether current flows (i.e. something is on the line). For measured lines, this is whether Milliamps exceeds the line's threshold (see CurrentConf).
 	Flow bool
+	// Milliamps is the current, if Measured (older devices only report Flow).
+	Milliamps int
+	Measured  bool
 }
 
 type ValShortNotify struct {
@@ -114,3 +134,46 @@ type ValShortNotify struct {
 func (s ValShortNotify) String() string {
 	return fmt.Sprintf("SL%sT%d", s.Line, s.Monotonic)
 }
+
+// ValConnState is published by a device's actor when the device is connected or disconnected.
+type ValConnState struct {
+	Id   Id
+	Path string
+	Up   bool
+}
+
+func (v ValConnState) String() string {
+	state := "down"
+	if v.Up {
+		state = "up"
+	}
+	return fmt.Sprintf("conn %s %s %s", v.Id, v.Path, state)
+}
+
+// ValCommandFailed is published by a line device's actor when a ReqLine or ReqSwitch was not applied (e.g. the device did not acknowledge it).
+// Exactly one of ReqLine and ReqSwitch is set.
+type ValCommandFailed struct {
+	ReqLine   *ReqLine
+	ReqSwitch *ReqSwitch
+	Err       string
+}
+
+func (v ValCommandFailed) String() string {
+	if v.ReqSwitch != nil {
+		return fmt.Sprintf("failed %s: %s", v.ReqSwitch, v.Err)
+	}
+	return fmt.Sprintf("failed %s: %s", v.ReqLine, v.Err)
+}
+
+// ValHeartbeat is published by a line device's actor when the device stops replying to heartbeats (or starts replying again).
+// Devices turn off all lines when they stop receiving heartbeats, so lines of a device that is not alive are in an unknown state.
+type ValHeartbeat struct {
+	Alive bool
+}
+
+func (v ValHeartbeat) String() string {
+	if v.Alive {
+		return "heartbeat alive"
+	}
+	return "heartbeat missing"
+}
@@ -0,0 +1,152 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	. "nyiyui.ca/hato/sakayukari"
+)
+
+// DefaultScanInterval is a reasonable interval for Watch.
+const DefaultScanInterval = 2 * time.Second
+
+// Watch calls Find every interval until ctx is done, so devices that are plugged in (again) are attached to their actors.
+func (s *State) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.stopOnce.Do(func() { close(s.stopped) })
+			return
+		case <-ticker.C:
+		}
+		err := s.find()
+		if err != nil {
+			log.Printf("watch: %s", err)
+		}
+	}
+}
+
+// slot attaches connections to a device to the actor made for the device in ConnActors, so the actor outlives connections to the device.
+type slot struct {
+	id    Id
+	actor Actor
+
+	lock sync.Mutex
+	// conn is the connected device, or nil.
+	conn *Conn
+	// input is the InputCh given to the handler of conn, or nil if there is none.
+	input chan Diffuse1
+	// gone is closed when conn is disconnected.
+	gone chan struct{}
+	// handlerDone is the Done given to the handler of conn.
+	handlerDone chan struct{}
+	// closed is true after the actor's InputCh was closed.
+	closed bool
+	// pumpDone is closed after the actor's InputCh was closed, or nil if the actor has no inputs.
+	pumpDone chan struct{}
+	// stopped is State.stopped.
+	stopped <-chan struct{}
+}
+
+func newSlot(id Id, a Actor, stopped <-chan struct{}) *slot {
+	sl := &slot{id: id, actor: a, stopped: stopped}
+	if a.Type.Input {
+		sl.pumpDone = make(chan struct{})
+	}
+	if a.Type.Input {
+		go sl.pump()
+	}
+	return sl
+}
+
+// pump sends diffuses for the actor to the handler of the connected device, or discards them if there is none.
+// When the actor's InputCh is closed, the handler's is closed, and the actor's Done is closed after the handler's.
+func (sl *slot) pump() {
+	for d := range sl.actor.InputCh {
+		sl.lock.Lock()
+		if sl.input == nil {
+			log.Printf("%s: not connected, discarding %s", sl.id, d.Value)
+		} else {
+			select {
+			case sl.input <- d:
+			case <-sl.gone:
+				log.Printf("%s: disconnected, discarding %s", sl.id, d.Value)
+			}
+		}
+		sl.lock.Unlock()
+	}
+	sl.lock.Lock()
+	sl.closed = true
+	close(sl.pumpDone)
+	input, handlerDone := sl.input, sl.handlerDone
+	sl.input = nil
+	sl.lock.Unlock()
+	if input != nil {
+		close(input)
+		<-handlerDone
+	}
+	if sl.actor.Done != nil {
+		close(sl.actor.Done)
+	}
+}
+
+// attach returns the Actor to give to the handler of c.
+func (sl *slot) attach(c *Conn) (Actor, error) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	if sl.closed {
+		return Actor{}, fmt.Errorf("%s: actor stopped", sl.id)
+	}
+	if sl.conn != nil {
+		return Actor{}, fmt.Errorf("%s: already connected on %s", sl.id, sl.conn.Path)
+	}
+	a := sl.actor
+	sl.conn = c
+	sl.gone = make(chan struct{})
+	if a.Type.Input {
+		sl.input = make(chan Diffuse1)
+		sl.handlerDone = make(chan struct{})
+		a.InputCh = sl.input
+		a.Done = sl.handlerDone
+	}
+	return a, nil
+}
+
+// detach is called after the handler of the connected device returns, and waits for the handler to finish.
+// It reports whether the actor is still running.
+func (sl *slot) detach() bool {
+	close(sl.gone)
+	sl.lock.Lock()
+	input, handlerDone := sl.input, sl.handlerDone
+	sl.input = nil
+	sl.lock.Unlock()
+	if input != nil {
+		close(input)
+	}
+	if handlerDone != nil {
+		<-handlerDone
+	}
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	sl.conn = nil
+	sl.handlerDone = nil
+	return !sl.closed
+}
+
+// publishState publishes a ValConnState for c, if the actor has outputs.
+// Nothing is published if the actor was stopped, as nothing receives from the actor's OutputCh anymore.
+func (sl *slot) publishState(c *Conn, up bool) {
+	if !sl.actor.Type.Output {
+		return
+	}
+	select {
+	case sl.actor.OutputCh <- Diffuse1{Value: ValConnState{Id: c.Id, Path: c.Path, Up: up}}:
+	case <-sl.pumpDone:
+	case <-sl.stopped:
+	}
+}
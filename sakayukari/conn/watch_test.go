@@ -0,0 +1,95 @@
+package conn
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	. "nyiyui.ca/hato/sakayukari"
+)
+
+// fakeDevice returns a Conn, and a channel of lines written to it.
+func fakeDevice(id Id, path string) (*Conn, net.Conn, <-chan string) {
+	host, device := net.Pipe()
+	lines := make(chan string, 16)
+	go func() {
+		defer close(lines)
+		r := bufio.NewReader(device)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- strings.TrimSpace(line)
+		}
+	}()
+	return &Conn{Id: id, Path: path, F: host}, device, lines
+}
+
+func TestReattach(t *testing.T) {
+	id := Id{Type: "soyuu-kdss", Variant: "v4", Instance: "test"}
+	s, as := ConnActors([]Id{id})
+	a := as[0]
+	req := ReqLine{Line: "A", Power: 100}
+
+	c1, device1, lines1 := fakeDevice(id, "/dev/test0")
+	go s.handleConn(c1)
+	if diff := cmp.Diff(ValConnState{Id: id, Path: "/dev/test0", Up: true}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("up (-want +got):\n%s", diff)
+	}
+	a.InputCh <- Diffuse1{Value: req}
+	if got := <-lines1; got != req.String() {
+		t.Fatalf("device 1 got %q", got)
+	}
+
+	device1.Close()
+	if diff := cmp.Diff(ValConnState{Id: id, Path: "/dev/test0", Up: false}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("down (-want +got):\n%s", diff)
+	}
+	// discarded as no device is connected
+	a.InputCh <- Diffuse1{Value: req}
+
+	c2, _, lines2 := fakeDevice(id, "/dev/test1")
+	go s.handleConn(c2)
+	if diff := cmp.Diff(ValConnState{Id: id, Path: "/dev/test1", Up: true}, (<-a.OutputCh).Value); diff != "" {
+		t.Fatalf("up again (-want +got):\n%s", diff)
+	}
+	a.InputCh <- Diffuse1{Value: req}
+	if got := <-lines2; got != req.String() {
+		t.Fatalf("device 2 got %q", got)
+	}
+
+	// closing the actor brakes lines on the connected device
+	close(a.InputCh)
+	want := ReqLine{Line: "A", Brake: true}
+	if got := <-lines2; got != want.String() {
+		t.Fatalf("shutdown: device 2 got %q", got)
+	}
+	<-a.Done
+}
+
+func TestWatchStopped(t *testing.T) {
+	id := Id{Type: "soyuu-kdss", Variant: "v4", Instance: "test"}
+	s, _ := ConnActors([]Id{id})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Watch(ctx, time.Hour)
+
+	// nothing receives ValConnStates, as the runtime stopped with Watch
+	c, device, _ := fakeDevice(id, "/dev/test0")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleConn(c)
+	}()
+	device.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handleConn blocked on publishing ValConnState")
+	}
+}
@@ -242,6 +242,16 @@ func WaypointControl(uiEvents, guide ActorRef, g *tal.Guide) Actor {
 							Target: &layout.LinePort{2, layout.PortB},
 						},
 					}
+				case "<Space>":
+					a.OutputCh <- Diffuse1{
+						Origin: guide,
+						Value:  tal.GuideEmergencyStop{},
+					}
+				case "R":
+					a.OutputCh <- Diffuse1{
+						Origin: guide,
+						Value:  tal.GuideEmergencyStop{Reset: true},
+					}
 				}
 			}
 		}
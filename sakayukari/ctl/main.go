@@ -1,6 +1,7 @@
 package ctl
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -23,9 +24,11 @@ func Main() error {
 		return fmt.Errorf("termui init: %w", err)
 	}
 	defer termui.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	g := Graph{
 		Actors: []Actor{
-			uiEvents(),
+			uiEvents(cancel),
 			latestKey(ActorRef{Index: 0}),
 		},
 	}
@@ -39,6 +42,7 @@ func Main() error {
 	if err != nil {
 		return fmt.Errorf("conn find: %w", err)
 	}
+	go connState.Watch(ctx, conn.DefaultScanInterval)
 	//rfid0 := ActorRef{Index: 4}
 	//rfid1 := ActorRef{Index: 5}
 	g.Actors = append(g.Actors, connActors...)
@@ -119,19 +123,20 @@ func Main() error {
 	//}))
 	g.Actors = append(g.Actors, WaypointControl(ActorRef{Index: 0}, guide, g2))
 
-	i := runtime.NewInstance(&g)
+	i := runtime.NewInstance(&g, runtime.InstanceConf{})
 	err = i.Check()
 	if err != nil {
 		return fmt.Errorf("check: %s", err)
 	}
-	err = i.Diffuse()
+	err = i.Diffuse(ctx)
 	if err != nil {
 		return fmt.Errorf("diffuse: %s", err)
 	}
 	return nil
 }
 
-func uiEvents() Actor {
+// uiEvents emits UIEvents, and calls cancel on <C-c>.
+func uiEvents(cancel context.CancelFunc) Actor {
 	a := Actor{
 		Comment:  "uiEvents",
 		OutputCh: make(chan Diffuse1),
@@ -142,7 +147,8 @@ func uiEvents() Actor {
 	go func() {
 		for e := range termui.PollEvents() {
 			if e.ID == "<C-c>" {
-				log.Fatalf("interrupt") // TODO: cleanup when exiting
+				cancel()
+				return
 			}
 			a.OutputCh <- Diffuse1{
 				Value: UIEvent{e},
@@ -154,6 +160,10 @@ func uiEvents() Actor {
 
 type UIEvent struct{ E termui.Event }
 
+func init() {
+	RegisterValue("ctl.UIEvent", UIEvent{})
+}
+
 func (u UIEvent) String() string {
 	return fmt.Sprint(u.E)
 }
@@ -1,30 +1,37 @@
 package ctl2
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/google/uuid"
 	"go.uber.org/zap"
 	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/config"
 	"nyiyui.ca/hato/sakayukari/conn"
 	"nyiyui.ca/hato/sakayukari/kujo"
 	"nyiyui.ca/hato/sakayukari/runtime"
 	"nyiyui.ca/hato/sakayukari/sakuragi"
 	"nyiyui.ca/hato/sakayukari/senri"
 	"nyiyui.ca/hato/sakayukari/tal"
-	"nyiyui.ca/hato/sakayukari/tal/cars"
-	"nyiyui.ca/hato/sakayukari/tal/layout"
 )
 
 func Main() error {
 	defer zap.S().Sync()
 	level := zap.LevelFlag("log-level", zap.DebugLevel, "set log level")
+	dotPath := flag.String("dot", "", "write the actor graph in Graphviz DOT format to this path (- for stdout) and exit")
+	remote := flag.String("remote", "", "use devices exported by conn-export at this address (instead of devices connected to this computer)")
+	tcp := flag.String("tcp", "", "comma-separated addresses (host:port) of devices reachable over TCP, e.g. through ser2net (instead of those in the config)")
+	capture := flag.String("capture", "", "capture all bytes sent to and received from devices into files in this directory (see conn-replay)")
+	configPath := flag.String("config", "config.json", "path to the config of the layout, devices, and trains")
 	flag.Parse()
 	cfg := zap.NewDevelopmentConfig()
 	cfg.Level = zap.NewAtomicLevelAt(*level)
@@ -33,39 +40,68 @@ func Main() error {
 		panic(err)
 	}
 	zap.ReplaceGlobals(dev)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	g := Graph{
-		Actors: []Actor{
-			Actor{
-				Comment:  "dummy",
-				OutputCh: make(chan Diffuse1),
-				Type:     ActorType{Output: true},
-			},
-		},
-	}
-	connState, connActors := conn.ConnActors([]conn.Id{
-		conn.Id{"soyuu-kdss", "v4", "peach"},
-	})
-	log.Printf("finding devices…")
-	err = connState.Find()
+	conf, err := config.Load(*configPath)
 	if err != nil {
-		return fmt.Errorf("conn find: %w", err)
+		return fmt.Errorf("load config: %w", err)
 	}
-	g.Actors = append(g.Actors, connActors...)
-	y, err := layout.InitTestbench6c()
+	y, err := conf.LoadLayout()
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("config: %w", err)
 	}
-	var carsData cars.Data
-	{
-		data, err := os.ReadFile("cars.json")
-		if err != nil {
-			return fmt.Errorf("read cars.json: %w", err)
+
+	b := NewBuilder()
+	connIds := conf.ConnIds()
+	var links []ActorRef
+	if *remote != "" {
+		refs := make([]ActorRef, len(connIds))
+		for j, id := range connIds {
+			refs[j] = b.Ref("conn " + id.String())
+		}
+		link, proxies := runtime.Import(runtime.ImportConf{
+			Addr: *remote,
+			Refs: refs,
+		})
+		for j, id := range connIds {
+			b.Add("conn "+id.String(), proxies[j])
 		}
-		err = json.Unmarshal(data, &carsData)
+		links = append(links, b.Add("link "+*remote, link))
+	} else {
+		connState, connActors := conn.ConnActors(connIds)
+		conf.SetupConns(connState)
+		if *tcp != "" {
+			connState.SetNetworkDevices(strings.Split(*tcp, ","))
+		}
+		if *capture != "" {
+			connState.SetCaptureDir(*capture)
+		}
+		log.Printf("finding devices…")
+		err = connState.Find()
 		if err != nil {
-			return fmt.Errorf("parse cars.json: %w", err)
+			return fmt.Errorf("conn find: %w", err)
 		}
+		go connState.Watch(ctx, conn.DefaultScanInterval)
+		for j, id := range connIds {
+			b.Add("conn "+id.String(), connActors[j])
+		}
+	}
+	conns := map[conn.Id]ActorRef{}
+	for _, id := range connIds {
+		conns[id] = b.Ref("conn " + id.String())
+	}
+	lineActors, err := conf.GuideActors(y, conns)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	rfids, err := conf.ModelRFIDs(y, conns)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	trains, err := conf.LoadTrains(y)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
 	}
 	data, _ := json.MarshalIndent(y, "", "  ")
 	log.Printf("layout: %s", data)
@@ -76,88 +112,72 @@ func Main() error {
 			DontDemo: true,
 			//Virtual: true,
 			Layout: y,
-			Actors: map[layout.LineID]ActorRef{
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "A"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "B"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "C"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "D"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "E"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "F"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "G"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "H"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "I"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "J"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "K"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "L"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "M"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "N"}: ActorRef{Index: 1},
-				layout.LineID{conn.Id{"soyuu-kdss", "v4", "peach"}, "O"}: ActorRef{Index: 1},
-			},
-			Cars: carsData,
+			Actors: lineActors,
+			Links:  links,
+			Cars:   conf.Cars,
 		})
-		g.Actors = append(g.Actors, actor)
+		b.Add("guide", actor)
 		g2.Model2.SetIgnoreWrites()
-		path := y.MustFullPathTo(
-			layout.LinePort{y.MustLookupIndex("nagase1"), layout.PortA},
-			layout.LinePort{y.MustLookupIndex("snb4"), layout.PortA},
-		)
-		path2 := y.MustFullPathTo(
-			layout.LinePort{y.MustLookupIndex("snb4"), layout.PortA},
-			layout.LinePort{y.MustLookupIndex("mitouc3"), layout.PortA},
-		)
-		path3 := y.MustFullPathTo(
-			layout.LinePort{y.MustLookupIndex("mitouc3"), layout.PortA},
-			layout.LinePort{y.MustLookupIndex("mitouc3"), layout.PortB},
-		)
-		_, _, _ = path, path2, path3
-		g2.InternalSetTrains([]tal.Train{
-			tal.Train{
-				Power:        0,
-				CurrentBack:  0,
-				CurrentFront: 0,
-				State:        tal.TrainStateNextAvail,
-				FormI:        uuid.MustParse("5a3df046-0de7-418a-a159-f7f24431ea75"),
-				Orient:       tal.FormOrientA,
-				Path:         &path,
-			},
-			tal.Train{
-				Power:        0,
-				CurrentBack:  0,
-				CurrentFront: 0,
-				State:        tal.TrainStateNextAvail,
-				FormI:        uuid.MustParse("a7453d82-d52f-43ec-84d2-54dcea72f8c1"),
-				Orient:       tal.FormOrientB,
-				Path:         &path2,
-			},
-		})
+		g2.InternalSetTrains(trains)
 		g2.PublishSnapshot()
 	}
-	guide := ActorRef{Index: len(g.Actors) - 1}
-	//g.Actors = append(g.Actors, WaypointControl(guide, g2))
-	g.Actors = append(g.Actors, *sakuragi.Sakuragi(sakuragi.Conf{
-		Guide:  guide,
-		Guide2: g2,
+	var model ActorRef
+	if len(rfids) > 0 {
+		model = b.Add("model", *tal.Model(tal.ModelConf{
+			Cars:  conf.Cars,
+			Guide: b.Ref("guide"),
+			RFIDs: rfids,
+			Clock: g2.Clock(),
+		}))
+	}
+	//b.Add("waypointControl", WaypointControl(b.Ref("guide"), g2))
+	stopper, stopperActor := tal.NewEmergencyStopper(b.Ref("guide"))
+	b.Add("emergency stopper", stopperActor)
+	b.Add("sakuragi", *sakuragi.Sakuragi(sakuragi.Conf{
+		Guide:   b.Ref("guide"),
+		Model:   model,
+		Guide2:  g2,
+		Stopper: stopper,
 	}))
-	sakuragi := ActorRef{Index: len(g.Actors) - 1}
-	_ = sakuragi
+	g, err := b.Build()
+	if err != nil {
+		return fmt.Errorf("build graph: %w", err)
+	}
+	if *dotPath != "" {
+		err = runtime.WriteDOTFile(*dotPath, g)
+		if err != nil {
+			return fmt.Errorf("write dot: %w", err)
+		}
+		return nil
+	}
 
 	log.Printf("starting kujo…")
-	kujoServer := kujo.NewServer(g2)
+	kujoServer := kujo.NewServer(g2, stopper)
 	go func() {
 		http.ListenAndServe("0.0.0.0:8001", kujoServer.Handler())
 	}()
 
 	go func() {
 		log.Printf("starting runtime…")
-		i := runtime.NewInstance(&g)
+		i := runtime.NewInstance(g, runtime.InstanceConf{
+			EmergencyStop: func(hung ActorRef) {
+				log.Printf("emergency stop: actor %s hung", hung)
+				stopper.Send(ctx, tal.GuideEmergencyStop{})
+			},
+		})
 		err = i.Check()
 		if err != nil {
 			log.Fatalf("check: %s", err)
 		}
-		err = i.Diffuse()
+		kujoServer.Handle("/debug/graph.dot", i.DOTHandler())
+		kujoServer.Handle("/metrics", i.MetricsHandler())
+		err = i.Diffuse(ctx)
 		if err != nil {
 			log.Fatalf("diffuse: %s", err)
 		}
+		// senri does not return by itself, so exit here
+		log.Printf("runtime shut down")
+		os.Exit(0)
 	}()
 
 	go func() {
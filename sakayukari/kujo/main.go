@@ -30,21 +30,25 @@ type Operation struct {
 
 type Server struct {
 	g       *tal.Guide
+	es      *tal.EmergencyStopper
 	s       *sse.Server
 	mux     *http.ServeMux
 	ETAMuxS *notify.MultiplexerSender[ETAReport]
 	etaMux  *notify.Multiplexer[ETAReport]
 }
 
-func NewServer(g *tal.Guide) *Server {
+func NewServer(g *tal.Guide, es *tal.EmergencyStopper) *Server {
 	s := &Server{
 		g:   g,
+		es:  es,
 		s:   sse.New(),
 		mux: http.NewServeMux(),
 	}
 	s.ETAMuxS, s.etaMux = notify.NewMultiplexerSender[ETAReport]("kujo ETA")
 	s.mux.Handle("/sse", s.s)
 	s.mux.HandleFunc("/platformdisplay", s.platformDisplay)
+	s.mux.HandleFunc("/emergency-stop", s.emergency(false))
+	s.mux.HandleFunc("/emergency-reset", s.emergency(true))
 	return s
 }
 
@@ -134,6 +138,27 @@ func (s *Server) platformDisplay(w http.ResponseWriter, r *http.Request) {
 	//}
 }
 
+// emergency returns a handler that stops all trains (or lets them run again if reset) on POST.
+func (s *Server) emergency(reset bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		err := s.es.Send(r.Context(), tal.GuideEmergencyStop{Reset: reset})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Handle registers h for pattern, e.g. for debugging endpoints of other packages.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
 func (s *Server) Handler() http.Handler {
 	return alice.New(cors.Default().Handler).Then(s.mux)
 }
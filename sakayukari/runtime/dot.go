@@ -0,0 +1,175 @@
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	. "nyiyui.ca/hato/sakayukari"
+)
+
+// edge is a route of diffuses from one actor to another.
+type edge struct {
+	From, To int
+}
+
+func (i *Instance) countEdges(from int, tos []int) {
+	for _, to := range tos {
+		v, ok := i.edges.Load(edge{from, to})
+		if !ok {
+			v, _ = i.edges.LoadOrStore(edge{from, to}, new(atomic.Uint64))
+		}
+		v.(*atomic.Uint64).Add(1)
+	}
+}
+
+// edgeCounts returns the number of diffuses routed for each edge so far.
+func (i *Instance) edgeCounts() map[edge]uint64 {
+	res := map[edge]uint64{}
+	i.edges.Range(func(k, v any) bool {
+		res[k.(edge)] = v.(*atomic.Uint64).Load()
+		return true
+	})
+	return res
+}
+
+// DOTConf configures Instance.WriteDOT.
+type DOTConf struct {
+	// Stats annotates actors and edges with the number of diffuses so far.
+	Stats bool
+}
+
+// WriteDOT writes g as a Graphviz DOT graph.
+// Solid edges are Inputs, and dashed edges are Outputs.
+func WriteDOT(w io.Writer, g *Graph) error {
+	return writeDOT(w, g.Actors, nil, nil)
+}
+
+// WriteDOTFile writes g as a Graphviz DOT graph (see WriteDOT) to the file at path, or to stdout if path is "-".
+func WriteDOTFile(path string, g *Graph) error {
+	if path == "-" {
+		return WriteDOT(os.Stdout, g)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = WriteDOT(f, g)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteDOT writes the running graph as a Graphviz DOT graph (see WriteDOT).
+// Edges of diffuses that were routed without an Inputs or Outputs edge (e.g. sets to actors not in Outputs) are dotted.
+func (i *Instance) WriteDOT(w io.Writer, conf DOTConf) error {
+	var stats []ActorStats
+	var edges map[edge]uint64
+	if conf.Stats {
+		stats = i.Stats()
+		edges = i.edgeCounts()
+	}
+	i.gLock.RLock()
+	actors := append([]Actor(nil), i.g.Actors...)
+	i.gLock.RUnlock()
+	return writeDOT(w, actors, stats, edges)
+}
+
+// DOTHandler serves the running graph as a Graphviz DOT graph with stats.
+func (i *Instance) DOTHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		err := i.WriteDOT(w, DOTConf{Stats: true})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func actorTypeFlags(t ActorType) string {
+	flags := make([]string, 0, 3)
+	if t.Input {
+		flags = append(flags, "input")
+	}
+	if t.LinearInput {
+		flags = append(flags, "linear")
+	}
+	if t.Output {
+		flags = append(flags, "output")
+	}
+	return strings.Join(flags, " ")
+}
+
+// writeDOT writes actors as a DOT graph.
+// If stats is not nil, actors are annotated with stats, and edges with edges.
+func writeDOT(w io.Writer, actors []Actor, stats []ActorStats, edges map[edge]uint64) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph sakayukari {")
+	fmt.Fprintln(bw, "\tnode [shape=box];")
+	for j, actor := range actors {
+		label := fmt.Sprintf("%s %s\n%s", ActorRef{Index: j}, actor.Comment, actorTypeFlags(actor.Type))
+		if stats != nil && j < len(stats) {
+			s := stats[j]
+			label += fmt.Sprintf("\nemitted %d, delivered %d", s.Emitted, s.Delivered)
+			if s.Pending != 0 {
+				label += fmt.Sprintf(", pending %d", s.Pending)
+			}
+			if s.Hangs != 0 {
+				label += fmt.Sprintf("\nhangs %d, dropped %d, restarted %d", s.Hangs, s.Dropped, s.Restarted)
+			}
+		}
+		fmt.Fprintf(bw, "\ta%d [label=%q];\n", j, label)
+	}
+	seen := map[edge]bool{}
+	writeEdge := func(e edge, style string) {
+		attrs := []string{"style=" + style}
+		if stats != nil {
+			attrs = append(attrs, fmt.Sprintf("label=\"%d\"", edges[e]))
+		}
+		fmt.Fprintf(bw, "\ta%d -> a%d [%s];\n", e.From, e.To, strings.Join(attrs, ", "))
+	}
+	for j, actor := range actors {
+		for _, input := range actor.Inputs {
+			e := edge{input.Index, j}
+			if seen[e] {
+				continue
+			}
+			seen[e] = true
+			writeEdge(e, "solid")
+		}
+	}
+	for j, actor := range actors {
+		for _, output := range actor.Outputs {
+			e := edge{j, output.Index}
+			if seen[e] {
+				continue
+			}
+			seen[e] = true
+			writeEdge(e, "dashed")
+		}
+	}
+	rest := make([]edge, 0)
+	for e := range edges {
+		if !seen[e] && e.From < len(actors) && e.To < len(actors) {
+			rest = append(rest, e)
+		}
+	}
+	sort.Slice(rest, func(a, b int) bool {
+		if rest[a].From != rest[b].From {
+			return rest[a].From < rest[b].From
+		}
+		return rest[a].To < rest[b].To
+	})
+	for _, e := range rest {
+		writeEdge(e, "dotted")
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
@@ -0,0 +1,83 @@
+package runtime
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	. "nyiyui.ca/hato/sakayukari"
+)
+
+func TestWriteDOT(t *testing.T) {
+	src := Actor{
+		Comment:  "src",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}
+	dst := Actor{
+		Comment: "dst",
+		InputCh: make(chan Diffuse1),
+		Inputs:  []ActorRef{{Index: 0}},
+		Type:    ActorType{Input: true, LinearInput: true},
+	}
+	g := Graph{Actors: []Actor{src, dst}}
+	i := NewInstance(&g, InstanceConf{Trace: TraceConf{Disabled: true}})
+	err := i.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go i.Diffuse(ctx)
+	src.OutputCh <- Diffuse1{Value: Message("a")}
+	<-dst.InputCh
+	for i.Stats()[1].Delivered == 0 {
+		// the counter is incremented after the send completes
+		time.Sleep(time.Millisecond)
+	}
+
+	var b strings.Builder
+	err = i.WriteDOT(&b, DOTConf{Stats: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph sakayukari {
+	node [shape=box];
+	a0 [label="<a:0> src\noutput\nemitted 1, delivered 0"];
+	a1 [label="<a:1> dst\ninput linear\nemitted 0, delivered 1"];
+	a0 -> a1 [style=solid, label="1"];
+}
+`
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Fatalf("(-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteDOTFile(t *testing.T) {
+	g := Graph{Actors: []Actor{{
+		Comment:  "src",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}}}
+	path := filepath.Join(t.TempDir(), "graph.dot")
+	err := WriteDOTFile(path, &g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph sakayukari {
+	node [shape=box];
+	a0 [label="<a:0> src\noutput"];
+}
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Fatalf("(-want +got):\n%s", diff)
+	}
+}
@@ -1,30 +1,106 @@
 package runtime
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
 	"reflect"
 	"sync"
+	"time"
 
 	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/clock"
+	"nyiyui.ca/hato/sakayukari/notify"
 )
 
 type Instance struct {
-	g           *Graph
-	traceOutput *os.File
+	g *Graph
+	// gLock controls access to g.Actors and dependsOn.
+	gLock      sync.RWMutex
+	dependsOn  [][]int
+	rebuild    chan struct{}
+	queues     map[int]*actorQueue
+	queuesLock sync.Mutex
+	counters   []actorCounters
+	// edges has the number of diffuses routed between actors (map[edge]*atomic.Uint64).
+	edges sync.Map
+	// types has metrics for each value type (map[string]*typeCounters).
+	types sync.Map
+	// stopped is closed when the Instance starts shutting down.
+	stopped chan struct{}
+	// stopLock is held while closing stopped, so sends started outside of Diffuse (see track) are all added to sends before shutdown waits on them.
+	stopLock sync.Mutex
+	// sends are all goroutines that can send to an InputCh.
+	sends    sync.WaitGroup
+	hangMuxS *notify.MultiplexerSender[Hang]
+	// HangMux receives all hangs of actors.
+	HangMux     *notify.Multiplexer[Hang]
+	conf        InstanceConf
+	clock       clock.Clock
+	traceOutput *traceSink
 	traceLock   sync.Mutex
 }
 
-func NewInstance(g *Graph) *Instance {
-	return &Instance{g: g}
+type InstanceConf struct {
+	Trace TraceConf
+	// Supervision is used for actors not in ActorSupervision.
+	Supervision      Supervision
+	ActorSupervision map[ActorRef]Supervision
+	// EmergencyStop is called when an actor with HangPolicyEmergencyStop hangs.
+	EmergencyStop func(hung ActorRef)
+	// Clock is used for traces, deadlines and metrics. If nil, clock.Real is used.
+	// Links (see Export and Import) always use real time, as network deadlines are in real time.
+	Clock clock.Clock
+	// ShutdownTimeout is how long to wait (in real time, regardless of Clock) for each actor's Done when shutting down.
+	// If 0, DefaultShutdownTimeout is used.
+	ShutdownTimeout time.Duration
 }
 
-func (i *Instance) ReplaceActor(ref ActorRef, a Actor) {
-	panic("not implemented")
+func NewInstance(g *Graph, conf InstanceConf) *Instance {
+	i := &Instance{
+		g:        g,
+		conf:     conf,
+		rebuild:  make(chan struct{}, 1),
+		queues:   map[int]*actorQueue{},
+		counters: make([]actorCounters, len(g.Actors)),
+		stopped:  make(chan struct{}),
+		clock:    clock.Or(conf.Clock),
+	}
+	i.hangMuxS, i.HangMux = notify.NewMultiplexerSender[Hang]("sakayukari-runtime hang")
+	return i
 }
 
-// TODO: change Graph while reducing execution interruption
+// ReplaceActor replaces the actor at ref with a, while Diffuse is running or not.
+// Dependents of ref keep receiving diffuses from the new actor, as their Inputs are unchanged.
+// If a.Inputs is nil, the Inputs of the old actor are used.
+// The old actor's channels are no longer used by the runtime after ReplaceActor returns, so the caller is responsible for stopping the old actor.
+func (i *Instance) ReplaceActor(ref ActorRef, a Actor) error {
+	i.gLock.Lock()
+	defer i.gLock.Unlock()
+	if ref.Index < 0 || ref.Index >= len(i.g.Actors) {
+		return fmt.Errorf("actor %s: out of range", ref)
+	}
+	if a.Inputs == nil {
+		a.Inputs = i.g.Actors[ref.Index].Inputs
+	}
+	for _, input := range a.Inputs {
+		if input.Index < 0 || input.Index >= len(i.g.Actors) {
+			return fmt.Errorf("actor %s %s: input %s out of range", ref, a.Comment, input)
+		}
+	}
+	err := checkActor(ref, &a)
+	if err != nil {
+		return err
+	}
+	i.g.Actors[ref.Index] = a
+	i.dependsOn = i.calcDependsOn()
+	select {
+	case i.rebuild <- struct{}{}:
+	default:
+		// a rebuild is already pending
+	}
+	return nil
+}
 
 func removeDuplicate[T comparable](sliceList []T) []T {
 	allKeys := make(map[T]bool)
@@ -38,7 +114,9 @@ func removeDuplicate[T comparable](sliceList []T) []T {
 	return list
 }
 
-func (i *Instance) dependsOn() [][]int {
+// calcDependsOn returns the dependents of each actor.
+// gLock must be taken.
+func (i *Instance) calcDependsOn() [][]int {
 	dependsOn := make([][]int, len(i.g.Actors))
 	for j, actor := range i.g.Actors {
 		for _, k := range actor.Inputs {
@@ -54,38 +132,57 @@ func (i *Instance) dependsOn() [][]int {
 	return dependsOn
 }
 
+func checkActor(ref ActorRef, actor *Actor) error {
+	if actor.Type.Output != (actor.OutputCh != nil) {
+		return fmt.Errorf("actor %s %s: type mismatch: output", ref, actor.Comment)
+	}
+	if actor.Type.Input != (actor.InputCh != nil) {
+		return fmt.Errorf("actor %s %s: type mismatch: input", ref, actor.Comment)
+	}
+	if actor.Type.Input == false && actor.Type.Output == false {
+		return fmt.Errorf("actor %s %s: type: no i/o", ref, actor.Comment)
+	}
+	return nil
+}
+
 func (i *Instance) Check() error {
 	err := i.initRecord()
 	if err != nil {
 		log.Printf("initRecord: %s", err)
 	}
-	for i, actor := range i.g.Actors {
-		if actor.Type.Output != (actor.OutputCh != nil) {
-			return fmt.Errorf("actor %s %s: type mismatch: output", ActorRef{Index: i}, actor.Comment)
-		}
-		if actor.Type.Input != (actor.InputCh != nil) {
-			return fmt.Errorf("actor %s %s: type mismatch: input", ActorRef{Index: i}, actor.Comment)
-		}
-		if actor.Type.Input == false && actor.Type.Output == false {
-			return fmt.Errorf("actor %s %s: type: no i/o", ActorRef{Index: i}, actor.Comment)
+	i.gLock.RLock()
+	defer i.gLock.RUnlock()
+	for j := range i.g.Actors {
+		err := checkActor(ActorRef{Index: j}, &i.g.Actors[j])
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (i *Instance) Diffuse() error {
-	if i.traceOutput != nil {
-		defer func() {
-			err := i.traceOutput.Close()
-			if err != nil {
-				log.Printf("sakayukari-runtime: close traceOutput: %s", err)
-			}
-		}()
+const (
+	caseRebuild = iota
+	caseDone
+	caseActors
+)
+
+// selectCases returns the cases to receive diffuses from all actors, and the actor index of each case.
+// The first caseActors cases are for rebuilding and shutting down (and do not have a valid actor index).
+// gLock must be taken.
+func (i *Instance) selectCases(ctx context.Context) (cases []reflect.SelectCase, caseIs []int) {
+	cases = []reflect.SelectCase{
+		caseRebuild: {
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(i.rebuild),
+		},
+		caseDone: {
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(ctx.Done()),
+		},
 	}
-	// setup cases
-	cases := []reflect.SelectCase{}
-	caseIs := []int{}
-	for i, actor := range i.g.Actors {
+	caseIs = []int{-1, -1}
+	for j, actor := range i.g.Actors {
 		if !actor.Type.Output {
 			continue
 		}
@@ -93,65 +190,111 @@ func (i *Instance) Diffuse() error {
 			Dir:  reflect.SelectRecv,
 			Chan: reflect.ValueOf(actor.OutputCh),
 		})
-		caseIs = append(caseIs, i)
+		caseIs = append(caseIs, j)
 	}
+	return
+}
 
-	dependsOn := i.dependsOn()
-	state := make([]Value, len(i.g.Actors))
+// Diffuse runs the Graph until ctx is done, after which the Graph is shut down (see shutdown).
+func (i *Instance) Diffuse(ctx context.Context) error {
+	if i.traceOutput != nil {
+		defer func() {
+			i.traceLock.Lock()
+			defer i.traceLock.Unlock()
+			err := i.traceOutput.Close()
+			if err != nil {
+				log.Printf("sakayukari-runtime: close traceOutput: %s", err)
+			}
+		}()
+	}
+	// setup cases
+	i.gLock.Lock()
+	i.dependsOn = i.calcDependsOn()
+	cases, caseIs := i.selectCases(ctx)
+	i.gLock.Unlock()
 	for {
 		// log.Printf("WAITING")
 		chosen, recv, recvOK := reflect.Select(cases)
+		switch chosen {
+		case caseRebuild:
+			i.gLock.RLock()
+			cases, caseIs = i.selectCases(ctx)
+			i.gLock.RUnlock()
+			continue
+		case caseDone:
+			i.shutdown()
+			return nil
+		}
 		if !recvOK {
 			panic("recvOK is false but only SelectRecv is used")
 		}
-		go func() {
-			var caseI int
-			caseI = caseIs[chosen]
-			d := recv.Interface().(Diffuse1)
-			//log.Printf("got: %s", d)
-			if d.Origin == (ActorRef{}) || d.Origin == Publish {
-				// self if blank
-				d.Origin = ActorRef{Index: caseI}
-				// only do dependencies if the actor itself publishes a new value; if the actor sends it to a different actor, that actor can decide to publichs a new value or not
-				//log.Printf("sending to deps of %s: %#v", d.Origin, dependsOn[d.Origin.Index])
-				i.record(&d, dependsOn[d.Origin.Index])
-				for _, j := range dependsOn[d.Origin.Index] {
-					i.send(j, &d)
-				}
-			} else if d.Origin == Loopback {
-				// send to self
-				//d.Origin = ActorRef{Index: caseI}
-				i.record(&d, []int{caseI})
-				// TODO: do we want to record if this was a loopback or not too?
-				i.send(caseI, &d)
-			} else {
-				// if not self, this Diffuse1 is a set to another actor
-				dest := d.Origin.Index
-				state[dest] = d.Value
-				origin := i.g.Actors[dest]
-				if !origin.Type.Input {
-					panic(fmt.Sprintf("input to non-input actor %s %s", d.Origin, origin.Comment))
-				}
-				d.Origin.Index = caseI
-				//log.Printf("send to %s: %s", d.Origin, d)
-				i.record(&d, []int{dest})
-				i.send(dest, &d)
-				//log.Printf("sent to %s: %s", d.Origin, d)
-			}
-			//log.Print("done this loop")
-			// TODO: handle hanging actors
-		}()
+		caseI := caseIs[chosen]
+		d := recv.Interface().(Diffuse1)
+		i.emitted(caseI, d)
+		i.route(caseI, d)
 	}
 }
 
-func (i *Instance) send(actorI int, d *Diffuse1) {
-	i.g.Actors[actorI].InputCh <- *d
-	/*
-		select {
-		case i.g.Actors[actorI].InputCh <- *d:
-		case <-time.After(500 * time.Millisecond):
-			pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
-			panic(fmt.Sprintf("actor %s %s timed out: %#v", ActorRef{Index: actorI}, i.g.Actors[actorI].Comment, d))
+// route sends a Diffuse1 received from the actor caseI to its destinations.
+// route does not block on delivery, so it can be called from the main loop; this keeps the order of diffuses for LinearInput actors.
+func (i *Instance) route(caseI int, d Diffuse1) {
+	//log.Printf("got: %s", d)
+	if d.Origin == (ActorRef{}) || d.Origin == Publish {
+		// self if blank
+		d.Origin = ActorRef{Index: caseI}
+		// only do dependencies if the actor itself publishes a new value; if the actor sends it to a different actor, that actor can decide to publichs a new value or not
+		i.gLock.RLock()
+		dests := i.dependsOn[d.Origin.Index]
+		i.gLock.RUnlock()
+		//log.Printf("sending to deps of %s: %#v", d.Origin, dests)
+		i.record(&d, dests)
+		i.countEdges(caseI, dests)
+		for _, j := range dests {
+			i.deliver(j, d)
 		}
-	*/
+	} else if d.Origin == Loopback {
+		// send to self
+		//d.Origin = ActorRef{Index: caseI}
+		i.record(&d, []int{caseI})
+		i.countEdges(caseI, []int{caseI})
+		// TODO: do we want to record if this was a loopback or not too?
+		i.deliver(caseI, d)
+	} else {
+		// if not self, this Diffuse1 is a set to another actor
+		dest := d.Origin.Index
+		i.gLock.RLock()
+		origin := i.g.Actors[dest]
+		i.gLock.RUnlock()
+		if !origin.Type.Input {
+			panic(fmt.Sprintf("input to non-input actor %s %s", d.Origin, origin.Comment))
+		}
+		d.Origin.Index = caseI
+		//log.Printf("send to %s: %s", d.Origin, d)
+		i.record(&d, []int{dest})
+		i.countEdges(caseI, []int{dest})
+		i.deliver(dest, d)
+		//log.Printf("sent to %s: %s", d.Origin, d)
+	}
+	//log.Print("done this loop")
+}
+
+// linear reports whether the actor actorI is a LinearInput actor.
+func (i *Instance) linear(actorI int) bool {
+	i.gLock.RLock()
+	defer i.gLock.RUnlock()
+	return i.g.Actors[actorI].Type.LinearInput
+}
+
+// deliver sends d to the actor actorI without blocking.
+// If the actor is a LinearInput actor, d is delivered after all diffuses previously delivered to the actor.
+func (i *Instance) deliver(actorI int, d Diffuse1) {
+	if i.linear(actorI) {
+		i.queue(actorI).push(d)
+	} else {
+		i.sends.Add(1)
+		go func() {
+			defer i.sends.Done()
+			i.send(actorI, &d)
+		}()
+	}
 }
@@ -0,0 +1,171 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "nyiyui.ca/hato/sakayukari"
+)
+
+func TestReplaceActor(t *testing.T) {
+	src := Actor{
+		Comment:  "src",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}
+	dst := Actor{
+		Comment: "dst",
+		InputCh: make(chan Diffuse1),
+		Inputs:  []ActorRef{{Index: 0}},
+		Type:    ActorType{Input: true},
+	}
+	g := Graph{Actors: []Actor{src, dst}}
+	i := NewInstance(&g, InstanceConf{Trace: TraceConf{Disabled: true}})
+	err := i.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go i.Diffuse(context.Background())
+	src.OutputCh <- Diffuse1{Value: Message("a")}
+	if d := <-dst.InputCh; d.Value != Message("a") {
+		t.Fatalf("unexpected %s", d)
+	}
+
+	dst2 := Actor{
+		Comment: "dst2",
+		InputCh: make(chan Diffuse1),
+		Type:    ActorType{Input: true},
+	}
+	err = i.ReplaceActor(ActorRef{Index: 1}, dst2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.OutputCh <- Diffuse1{Value: Message("b")}
+	if d := <-dst2.InputCh; d.Value != Message("b") || d.Origin != (ActorRef{Index: 0}) {
+		t.Fatalf("unexpected %s", d)
+	}
+
+	src2 := Actor{
+		Comment:  "src2",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}
+	err = i.ReplaceActor(ActorRef{Index: 0}, src2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case src2.OutputCh <- Diffuse1{Value: Message("c")}:
+	case <-time.After(time.Second):
+		t.Fatal("select cases not rebuilt")
+	}
+	if d := <-dst2.InputCh; d.Value != Message("c") {
+		t.Fatalf("unexpected %s", d)
+	}
+
+	err = i.ReplaceActor(ActorRef{Index: 1}, Actor{Comment: "invalid", Type: ActorType{Input: true}})
+	if err == nil {
+		t.Fatal("expected type mismatch error")
+	}
+}
+
+func TestLinearInput(t *testing.T) {
+	src := Actor{
+		Comment:  "src",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}
+	slow := Actor{
+		Comment: "slow",
+		InputCh: make(chan Diffuse1),
+		Inputs:  []ActorRef{{Index: 0}},
+		Type:    ActorType{Input: true, LinearInput: true},
+	}
+	fast := Actor{
+		Comment: "fast",
+		InputCh: make(chan Diffuse1),
+		Inputs:  []ActorRef{{Index: 0}},
+		Type:    ActorType{Input: true, LinearInput: true},
+	}
+	g := Graph{Actors: []Actor{src, slow, fast}}
+	i := NewInstance(&g, InstanceConf{Trace: TraceConf{Disabled: true}})
+	err := i.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go i.Diffuse(context.Background())
+	const n = 100
+	for j := 0; j < n; j++ {
+		src.OutputCh <- Diffuse1{Value: Message(fmt.Sprint(j))}
+	}
+	// fast is not blocked by slow not receiving anything yet
+	for j := 0; j < n; j++ {
+		d := <-fast.InputCh
+		if d.Value != Message(fmt.Sprint(j)) {
+			t.Fatalf("fast: expected %d, got %s", j, d.Value)
+		}
+	}
+	for j := 0; j < n; j++ {
+		d := <-slow.InputCh
+		if d.Value != Message(fmt.Sprint(j)) {
+			t.Fatalf("slow: expected %d, got %s", j, d.Value)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	closed := make(chan string, 2)
+	hardware := Actor{
+		Comment:  "hardware",
+		InputCh:  make(chan Diffuse1),
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Input: true, Output: true},
+		Done:     make(chan struct{}),
+	}
+	go func() {
+		for range hardware.InputCh {
+		}
+		// sending while shutting down must not block
+		hardware.OutputCh <- Diffuse1{Value: Message("bye")}
+		closed <- "hardware"
+		close(hardware.Done)
+	}()
+	controller := Actor{
+		Comment:  "controller",
+		InputCh:  make(chan Diffuse1),
+		OutputCh: make(chan Diffuse1),
+		Inputs:   []ActorRef{{Index: 0}},
+		Type:     ActorType{Input: true, LinearInput: true, Output: true},
+		Done:     make(chan struct{}),
+	}
+	go func() {
+		for range controller.InputCh {
+		}
+		closed <- "controller"
+		close(controller.Done)
+	}()
+	g := Graph{Actors: []Actor{hardware, controller}}
+	i := NewInstance(&g, InstanceConf{Trace: TraceConf{Disabled: true}})
+	err := i.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- i.Diffuse(ctx) }()
+	hardware.OutputCh <- Diffuse1{Value: Message("a")}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Diffuse did not return")
+	}
+	if first := <-closed; first != "controller" {
+		t.Fatalf("%s closed before controller", first)
+	}
+}
@@ -0,0 +1,160 @@
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "nyiyui.ca/hato/sakayukari"
+)
+
+// latencyBuckets are the upper bounds (in seconds) of the buckets of latency histograms.
+var latencyBuckets = [...]float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+// histogram is a latency histogram with latencyBuckets.
+type histogram struct {
+	// buckets are not cumulative; the last one is +Inf.
+	buckets [len(latencyBuckets) + 1]atomic.Uint64
+	sum     atomic.Int64
+	count   atomic.Uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	j := sort.SearchFloat64s(latencyBuckets[:], s)
+	h.buckets[j].Add(1)
+	h.sum.Add(int64(d))
+	h.count.Add(1)
+}
+
+// typeCounters has metrics of a value type.
+type typeCounters struct {
+	emitted     atomic.Uint64
+	delivered   atomic.Uint64
+	sendLatency histogram
+}
+
+func valueTypeName(v Value) string {
+	name, ok := ValueName(v)
+	if !ok {
+		name = fmt.Sprintf("%T", v)
+	}
+	return name
+}
+
+func (i *Instance) typeCounters(v Value) *typeCounters {
+	name := valueTypeName(v)
+	tc, ok := i.types.Load(name)
+	if !ok {
+		tc, _ = i.types.LoadOrStore(name, new(typeCounters))
+	}
+	return tc.(*typeCounters)
+}
+
+// emitted counts a diffuse received from the actor actorI.
+func (i *Instance) emitted(actorI int, d Diffuse1) {
+	i.counters[actorI].emitted.Add(1)
+	i.typeCounters(d.Value).emitted.Add(1)
+}
+
+// delivered counts a diffuse sent to the actor actorI, which took since start to send.
+func (i *Instance) delivered(actorI int, d *Diffuse1, start time.Time) {
+	latency := i.clock.Since(start)
+	c := &i.counters[actorI]
+	c.delivered.Add(1)
+	c.sendLatency.observe(latency)
+	tc := i.typeCounters(d.Value)
+	tc.delivered.Add(1)
+	tc.sendLatency.observe(latency)
+}
+
+// MetricsHandler serves per-actor and per-value-type metrics in the Prometheus text format.
+func (i *Instance) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := i.WriteMetrics(w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// WriteMetrics writes per-actor and per-value-type metrics in the Prometheus text format.
+func (i *Instance) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	stats := i.Stats()
+	actorLabels := func(s ActorStats) string {
+		return fmt.Sprintf(`actor="%d",comment="%s"`, s.Actor.Index, escapeLabel(s.Comment))
+	}
+	header := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	actorMetric := func(name, typ, help string, value func(s ActorStats) string) {
+		header(name, typ, help)
+		for _, s := range stats {
+			fmt.Fprintf(bw, "%s{%s} %s\n", name, actorLabels(s), value(s))
+		}
+	}
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	actorMetric("sakayukari_actor_emitted_total", "counter", "Diffuses received from the actor's OutputCh.", func(s ActorStats) string { return u(s.Emitted) })
+	actorMetric("sakayukari_actor_delivered_total", "counter", "Diffuses sent to the actor's InputCh.", func(s ActorStats) string { return u(s.Delivered) })
+	actorMetric("sakayukari_actor_pending", "gauge", "Diffuses queued for a LinearInput actor.", func(s ActorStats) string { return strconv.Itoa(s.Pending) })
+	actorMetric("sakayukari_actor_hangs_total", "counter", "Deliveries that missed the actor's deadline.", func(s ActorStats) string { return u(s.Hangs) })
+	actorMetric("sakayukari_actor_dropped_total", "counter", "Diffuses dropped due to hangs.", func(s ActorStats) string { return u(s.Dropped) })
+	actorMetric("sakayukari_actor_restarted_total", "counter", "Restarts due to hangs.", func(s ActorStats) string { return u(s.Restarted) })
+	header("sakayukari_actor_send_seconds", "histogram", "Time taken to send a diffuse to the actor's InputCh.")
+	for _, s := range stats {
+		writeHistogram(bw, "sakayukari_actor_send_seconds", actorLabels(s), &i.counters[s.Actor.Index].sendLatency)
+	}
+
+	types := map[string]*typeCounters{}
+	names := make([]string, 0)
+	i.types.Range(func(k, v any) bool {
+		types[k.(string)] = v.(*typeCounters)
+		names = append(names, k.(string))
+		return true
+	})
+	sort.Strings(names)
+	typeLabels := func(name string) string {
+		return fmt.Sprintf(`type="%s"`, escapeLabel(name))
+	}
+	header("sakayukari_value_emitted_total", "counter", "Diffuses received from actors, by value type.")
+	for _, name := range names {
+		fmt.Fprintf(bw, "sakayukari_value_emitted_total{%s} %d\n", typeLabels(name), types[name].emitted.Load())
+	}
+	header("sakayukari_value_delivered_total", "counter", "Diffuses sent to actors, by value type.")
+	for _, name := range names {
+		fmt.Fprintf(bw, "sakayukari_value_delivered_total{%s} %d\n", typeLabels(name), types[name].delivered.Load())
+	}
+	header("sakayukari_value_send_seconds", "histogram", "Time taken to send a diffuse to an actor's InputCh, by value type.")
+	for _, name := range names {
+		writeHistogram(bw, "sakayukari_value_send_seconds", typeLabels(name), &types[name].sendLatency)
+	}
+	return bw.Flush()
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	var cumulative uint64
+	for j := range h.buckets {
+		cumulative += h.buckets[j].Load()
+		le := "+Inf"
+		if j < len(latencyBuckets) {
+			le = strconv.FormatFloat(latencyBuckets[j], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(time.Duration(h.sum.Load()).Seconds(), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count.Load())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,62 @@
+package runtime
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	. "nyiyui.ca/hato/sakayukari"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	src := Actor{
+		Comment:  `src "1"`,
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}
+	dst := Actor{
+		Comment: "dst",
+		InputCh: make(chan Diffuse1),
+		Inputs:  []ActorRef{{Index: 0}},
+		Type:    ActorType{Input: true},
+	}
+	g := Graph{Actors: []Actor{src, dst}}
+	i := NewInstance(&g, InstanceConf{Trace: TraceConf{Disabled: true}})
+	err := i.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go i.Diffuse(ctx)
+	for j := 0; j < 2; j++ {
+		src.OutputCh <- Diffuse1{Value: Message("a")}
+		<-dst.InputCh
+	}
+	for i.Stats()[1].Delivered < 2 {
+		// the counter is incremented after the send completes
+		time.Sleep(time.Millisecond)
+	}
+
+	var b strings.Builder
+	err = i.WriteMetrics(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	for _, want := range []string{
+		"# TYPE sakayukari_actor_emitted_total counter\n",
+		`sakayukari_actor_emitted_total{actor="0",comment="src \"1\""} 2` + "\n",
+		`sakayukari_actor_delivered_total{actor="1",comment="dst"} 2` + "\n",
+		`sakayukari_actor_send_seconds_bucket{actor="1",comment="dst",le="+Inf"} 2` + "\n",
+		`sakayukari_actor_send_seconds_count{actor="1",comment="dst"} 2` + "\n",
+		`sakayukari_value_emitted_total{type="sakayukari.Message"} 2` + "\n",
+		`sakayukari_value_delivered_total{type="sakayukari.Message"} 2` + "\n",
+		`sakayukari_value_send_seconds_count{type="sakayukari.Message"} 2` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
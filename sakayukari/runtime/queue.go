@@ -0,0 +1,97 @@
+package runtime
+
+import (
+	"sync"
+
+	. "nyiyui.ca/hato/sakayukari"
+)
+
+// actorQueue delivers diffuses to a LinearInput actor in the order they were pushed.
+// Pushing never blocks, so a slow actor does not block the main loop.
+type actorQueue struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	items  []Diffuse1
+	closed bool
+}
+
+func newActorQueue() *actorQueue {
+	q := &actorQueue{}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *actorQueue) push(d Diffuse1) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.items = append(q.items, d)
+	q.cond.Signal()
+}
+
+// pop blocks until a diffuse is available, and returns it.
+// If the queue is closed, ok is false.
+func (q *actorQueue) pop() (d Diffuse1, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return Diffuse1{}, false
+	}
+	d = q.items[0]
+	q.items[0] = Diffuse1{}
+	q.items = q.items[1:]
+	return d, true
+}
+
+// close discards all pending diffuses, and makes pop return.
+func (q *actorQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.items = nil
+	q.cond.Broadcast()
+}
+
+// Len returns the number of diffuses waiting to be delivered.
+func (q *actorQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
+
+// run delivers diffuses to the actor actorI until the queue is closed.
+func (q *actorQueue) run(i *Instance, actorI int) {
+	defer i.sends.Done()
+	for {
+		d, ok := q.pop()
+		if !ok {
+			return
+		}
+		i.send(actorI, &d)
+	}
+}
+
+// queue returns the queue for the actor actorI, making one if it does not exist yet.
+func (i *Instance) queue(actorI int) *actorQueue {
+	i.queuesLock.Lock()
+	defer i.queuesLock.Unlock()
+	q, ok := i.queues[actorI]
+	if !ok {
+		q = newActorQueue()
+		select {
+		case <-i.stopped:
+			// made after shutdown closed the queues (e.g. by Replay)
+			q.closed = true
+		default:
+		}
+		i.queues[actorI] = q
+		i.sends.Add(1)
+		go q.run(i, actorI)
+	}
+	return q
+}
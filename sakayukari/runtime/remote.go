@@ -0,0 +1,443 @@
+package runtime
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "nyiyui.ca/hato/sakayukari"
+)
+
+// DefaultHeartbeatInterval is used when HeartbeatInterval is 0 in ExportConf or ImportConf.
+// A link is considered lost if nothing is received for 3 heartbeat intervals.
+const DefaultHeartbeatInterval = 1 * time.Second
+
+// DefaultRetryInterval is used when ImportConf.RetryInterval is 0.
+const DefaultRetryInterval = 1 * time.Second
+
+// wireMessage is a diffuse sent over a link.
+// A link is a stream of JSON-encoded wireMessages.
+type wireMessage struct {
+	// Actor is the index of the actor in ExportConf.Actors, or -1 for heartbeats.
+	Actor int
+	// Type is the name the value's type was registered under (see RegisterValue).
+	Type  string          `json:",omitempty"`
+	Value json.RawMessage `json:",omitempty"`
+}
+
+func encodeWire(k int, v Value) (wireMessage, error) {
+	name, ok := ValueName(v)
+	if !ok {
+		return wireMessage{}, fmt.Errorf("value type %T not registered", v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return wireMessage{}, fmt.Errorf("value type %s: %w", name, err)
+	}
+	return wireMessage{Actor: k, Type: name, Value: data}, nil
+}
+
+// linkConn is a single connection of a link.
+type linkConn struct {
+	conn      net.Conn
+	heartbeat time.Duration
+	writeLock sync.Mutex
+	enc       *json.Encoder
+}
+
+func newLinkConn(conn net.Conn, heartbeat time.Duration) *linkConn {
+	if heartbeat == 0 {
+		heartbeat = DefaultHeartbeatInterval
+	}
+	return &linkConn{
+		conn:      conn,
+		heartbeat: heartbeat,
+		enc:       json.NewEncoder(conn),
+	}
+}
+
+// write sends m. If writing fails, the connection is closed.
+func (lc *linkConn) write(m wireMessage) error {
+	lc.writeLock.Lock()
+	defer lc.writeLock.Unlock()
+	lc.conn.SetWriteDeadline(time.Now().Add(3 * lc.heartbeat))
+	err := lc.enc.Encode(m)
+	if err != nil {
+		lc.conn.Close()
+	}
+	return err
+}
+
+// run sends heartbeats, and calls handle for each message received, until the connection fails or is closed.
+func (lc *linkConn) run(handle func(m wireMessage)) error {
+	defer lc.conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(lc.heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			if lc.write(wireMessage{Actor: -1}) != nil {
+				return
+			}
+		}
+	}()
+	dec := json.NewDecoder(bufio.NewReader(lc.conn))
+	for {
+		lc.conn.SetReadDeadline(time.Now().Add(3 * lc.heartbeat))
+		var m wireMessage
+		err := dec.Decode(&m)
+		if err != nil {
+			return err
+		}
+		if m.Actor == -1 {
+			continue
+		}
+		handle(m)
+	}
+}
+
+// ExportConf configures Export.
+type ExportConf struct {
+	Comment string
+	// Listener accepts connections from Import. Only the latest connection is used.
+	Listener net.Listener
+	// Actors are the local actors to export. On the importing side, the proxy for Actors[k] is proxies[k].
+	Actors            []ActorRef
+	HeartbeatInterval time.Duration
+}
+
+type exporter struct {
+	conf    ExportConf
+	actor   Actor
+	lock    sync.Mutex
+	current *linkConn
+	// latest has the latest value published by each exported actor, to be sent when an importer connects.
+	latest  map[int]wireMessage
+	stopped chan struct{}
+}
+
+// Export returns an actor that sends values published by conf.Actors to the Import connected to conf.Listener, and sets values received from it to conf.Actors.
+// It publishes ValLinkState when an Import connects or disconnects.
+func Export(conf ExportConf) Actor {
+	e := &exporter{
+		conf: conf,
+		actor: Actor{
+			Comment:  strings.TrimSpace(fmt.Sprintf("%s export %s", conf.Comment, conf.Listener.Addr())),
+			InputCh:  make(chan Diffuse1),
+			OutputCh: make(chan Diffuse1),
+			Inputs:   conf.Actors,
+			Type: ActorType{
+				Input:       true,
+				LinearInput: true,
+				Output:      true,
+			},
+		},
+		latest:  map[int]wireMessage{},
+		stopped: make(chan struct{}),
+	}
+	go e.accept()
+	go e.forward()
+	return e.actor
+}
+
+func (e *exporter) send(d Diffuse1) {
+	select {
+	case e.actor.OutputCh <- d:
+	case <-e.stopped:
+	}
+}
+
+func (e *exporter) publish(up bool) {
+	e.send(Diffuse1{Value: ValLinkState{
+		Addr:   e.conf.Listener.Addr().String(),
+		Up:     up,
+		Actors: e.conf.Actors,
+	}})
+}
+
+func (e *exporter) forward() {
+	defer func() {
+		close(e.stopped)
+		e.conf.Listener.Close()
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		if e.current != nil {
+			e.current.conn.Close()
+		}
+	}()
+	for d := range e.actor.InputCh {
+		k := -1
+		for j, ref := range e.conf.Actors {
+			if ref == d.Origin {
+				k = j
+				break
+			}
+		}
+		if k == -1 {
+			log.Printf("sakayukari-runtime: export: diffuse from non-exported actor %s", d.Origin)
+			continue
+		}
+		m, err := encodeWire(k, d.Value)
+		if err != nil {
+			log.Printf("sakayukari-runtime: export: %s", err)
+			continue
+		}
+		e.lock.Lock()
+		e.latest[k] = m
+		lc := e.current
+		e.lock.Unlock()
+		if lc == nil {
+			continue
+		}
+		err = lc.write(m)
+		if err != nil {
+			log.Printf("sakayukari-runtime: export: write: %s", err)
+		}
+	}
+}
+
+func (e *exporter) accept() {
+	for {
+		conn, err := e.conf.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("sakayukari-runtime: export: accept: %s", err)
+			continue
+		}
+		lc := newLinkConn(conn, e.conf.HeartbeatInterval)
+		e.lock.Lock()
+		old := e.current
+		e.current = lc
+		// send latest values while locked, so they are not sent after newer values
+		ks := make([]int, 0, len(e.latest))
+		for k := range e.latest {
+			ks = append(ks, k)
+		}
+		sort.Ints(ks)
+		for _, k := range ks {
+			err = lc.write(e.latest[k])
+			if err != nil {
+				break
+			}
+		}
+		e.lock.Unlock()
+		if old != nil {
+			old.conn.Close()
+		}
+		go e.serve(lc)
+	}
+}
+
+func (e *exporter) serve(lc *linkConn) {
+	log.Printf("sakayukari-runtime: export: %s connected", lc.conn.RemoteAddr())
+	e.publish(true)
+	err := lc.run(func(m wireMessage) {
+		if m.Actor < 0 || m.Actor >= len(e.conf.Actors) {
+			log.Printf("sakayukari-runtime: export: actor %d out of range", m.Actor)
+			return
+		}
+		v, err := DecodeValue(m.Type, m.Value)
+		if err != nil {
+			log.Printf("sakayukari-runtime: export: %s", err)
+			return
+		}
+		e.send(Diffuse1{Origin: e.conf.Actors[m.Actor], Value: v})
+	})
+	log.Printf("sakayukari-runtime: export: %s disconnected: %s", lc.conn.RemoteAddr(), err)
+	e.lock.Lock()
+	current := e.current == lc
+	if current {
+		e.current = nil
+	}
+	e.lock.Unlock()
+	// if not current, a newer connection replaced this one (and published up)
+	if current {
+		e.publish(false)
+	}
+}
+
+// ImportConf configures Import.
+type ImportConf struct {
+	Comment string
+	// Addr is the address of the Export's listener.
+	Addr string
+	// Refs are the refs the proxies are added under, in the same order as ExportConf.Actors of the Export.
+	Refs              []ActorRef
+	RetryInterval     time.Duration
+	HeartbeatInterval time.Duration
+}
+
+type importer struct {
+	conf    ImportConf
+	link    Actor
+	proxies []Actor
+	lock    sync.Mutex
+	current *linkConn
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// Import returns proxies of the actors exported by the Export listening on conf.Addr, and an actor that publishes ValLinkState when the link goes up or down.
+// Values published by the remote actors are published by the proxies, and values set to the proxies are set to the remote actors.
+// Values set while the link is down are discarded.
+// If the link is lost, Import reconnects every conf.RetryInterval until the proxies are closed.
+func Import(conf ImportConf) (link Actor, proxies []Actor) {
+	if conf.RetryInterval == 0 {
+		conf.RetryInterval = DefaultRetryInterval
+	}
+	im := &importer{
+		conf: conf,
+		link: Actor{
+			Comment:  strings.TrimSpace(fmt.Sprintf("%s import link %s", conf.Comment, conf.Addr)),
+			OutputCh: make(chan Diffuse1),
+			Type:     ActorType{Output: true},
+		},
+		proxies: make([]Actor, len(conf.Refs)),
+	}
+	im.ctx, im.cancel = context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for k := range im.proxies {
+		im.proxies[k] = Actor{
+			Comment:  strings.TrimSpace(fmt.Sprintf("%s import %s #%d", conf.Comment, conf.Addr, k)),
+			InputCh:  make(chan Diffuse1),
+			OutputCh: make(chan Diffuse1),
+			Type: ActorType{
+				Input:       true,
+				LinearInput: true,
+				Output:      true,
+			},
+		}
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			im.forward(k)
+		}(k)
+	}
+	go func() {
+		wg.Wait()
+		im.cancel()
+		im.lock.Lock()
+		defer im.lock.Unlock()
+		if im.current != nil {
+			im.current.conn.Close()
+		}
+	}()
+	go im.dial()
+	return im.link, im.proxies
+}
+
+func (im *importer) send(ch chan Diffuse1, d Diffuse1) {
+	select {
+	case ch <- d:
+	case <-im.ctx.Done():
+	}
+}
+
+func (im *importer) forward(k int) {
+	for d := range im.proxies[k].InputCh {
+		m, err := encodeWire(k, d.Value)
+		if err != nil {
+			log.Printf("sakayukari-runtime: import %s: %s", im.conf.Addr, err)
+			continue
+		}
+		im.lock.Lock()
+		lc := im.current
+		im.lock.Unlock()
+		if lc == nil {
+			log.Printf("sakayukari-runtime: import %s: link down; discarding %s", im.conf.Addr, d)
+			continue
+		}
+		err = lc.write(m)
+		if err != nil {
+			log.Printf("sakayukari-runtime: import %s: write: %s", im.conf.Addr, err)
+		}
+	}
+}
+
+func (im *importer) publish(up bool) {
+	im.send(im.link.OutputCh, Diffuse1{Value: ValLinkState{
+		Addr:   im.conf.Addr,
+		Up:     up,
+		Actors: im.conf.Refs,
+	}})
+}
+
+func (im *importer) dial() {
+	// known is false until the link is known to be up or down
+	known, up := false, false
+	setUp := func(newUp bool) {
+		if known && up == newUp {
+			return
+		}
+		known, up = true, newUp
+		im.publish(up)
+	}
+	heartbeat := im.conf.HeartbeatInterval
+	if heartbeat == 0 {
+		heartbeat = DefaultHeartbeatInterval
+	}
+	dialer := net.Dialer{Timeout: 3 * heartbeat}
+	for {
+		conn, err := dialer.DialContext(im.ctx, "tcp", im.conf.Addr)
+		if im.ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			if !known || up {
+				log.Printf("sakayukari-runtime: import %s: %s", im.conf.Addr, err)
+			}
+			setUp(false)
+		} else {
+			lc := newLinkConn(conn, heartbeat)
+			im.lock.Lock()
+			im.current = lc
+			im.lock.Unlock()
+			log.Printf("sakayukari-runtime: import %s: connected", im.conf.Addr)
+			setUp(true)
+			err = lc.run(func(m wireMessage) {
+				if m.Actor < 0 || m.Actor >= len(im.proxies) {
+					log.Printf("sakayukari-runtime: import %s: actor %d out of range", im.conf.Addr, m.Actor)
+					return
+				}
+				v, err := DecodeValue(m.Type, m.Value)
+				if err != nil {
+					log.Printf("sakayukari-runtime: import %s: %s", im.conf.Addr, err)
+					return
+				}
+				im.send(im.proxies[m.Actor].OutputCh, Diffuse1{Value: v})
+			})
+			im.lock.Lock()
+			im.current = nil
+			im.lock.Unlock()
+			if im.ctx.Err() != nil {
+				return
+			}
+			log.Printf("sakayukari-runtime: import %s: disconnected: %s", im.conf.Addr, err)
+			setUp(false)
+		}
+		select {
+		case <-time.After(im.conf.RetryInterval):
+		case <-im.ctx.Done():
+			return
+		}
+	}
+}
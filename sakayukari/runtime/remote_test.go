@@ -0,0 +1,135 @@
+package runtime
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "nyiyui.ca/hato/sakayukari"
+)
+
+// recordingListener keeps the latest accepted connection, so tests can break the link.
+type recordingListener struct {
+	net.Listener
+	lock   sync.Mutex
+	latest net.Conn
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.lock.Lock()
+		l.latest = conn
+		l.lock.Unlock()
+	}
+	return conn, err
+}
+
+func receive(t *testing.T, ch chan Diffuse1) Diffuse1 {
+	t.Helper()
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+		panic("unreachable")
+	}
+}
+
+func TestRemote(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const heartbeat = 50 * time.Millisecond
+
+	// host A has the sensor
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := &recordingListener{Listener: l}
+	ba := NewBuilder()
+	sensor := Actor{
+		InputCh:  make(chan Diffuse1),
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Input: true, Output: true},
+	}
+	ba.Add("sensor", sensor)
+	ba.Add("export", Export(ExportConf{
+		Listener:          rl,
+		Actors:            []ActorRef{ba.Ref("sensor")},
+		HeartbeatInterval: heartbeat,
+	}))
+	ga, err := ba.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ia := NewInstance(ga, InstanceConf{Trace: TraceConf{Disabled: true}})
+	err = ia.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ia.Diffuse(ctx)
+
+	// host B uses the sensor
+	bb := NewBuilder()
+	link, proxies := Import(ImportConf{
+		Addr:              l.Addr().String(),
+		Refs:              []ActorRef{bb.Ref("sensor")},
+		RetryInterval:     heartbeat,
+		HeartbeatInterval: heartbeat,
+	})
+	bb.Add("sensor", proxies[0])
+	bb.Add("link", link)
+	user := Actor{
+		InputCh:  make(chan Diffuse1),
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Input: true, Output: true},
+	}
+	bb.Add("user", user, "sensor", "link")
+	gb, err := bb.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ib := NewInstance(gb, InstanceConf{Trace: TraceConf{Disabled: true}})
+	err = ib.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ib.Diffuse(ctx)
+
+	d := receive(t, user.InputCh)
+	if ls, ok := d.Value.(ValLinkState); !ok || !ls.Up || ls.Actors[0] != bb.Ref("sensor") {
+		t.Fatalf("unexpected %s", d)
+	}
+
+	sensor.OutputCh <- Diffuse1{Value: Message("a")}
+	d = receive(t, user.InputCh)
+	if d.Value != Message("a") || d.Origin != bb.Ref("sensor") {
+		t.Fatalf("unexpected %s", d)
+	}
+
+	user.OutputCh <- Diffuse1{Origin: bb.Ref("sensor"), Value: Message("set")}
+	d = receive(t, sensor.InputCh)
+	if d.Value != Message("set") || d.Origin != ba.Ref("export") {
+		t.Fatalf("unexpected %s", d)
+	}
+
+	// break the link; Import should reconnect, and receive the latest value again
+	rl.lock.Lock()
+	rl.latest.Close()
+	rl.lock.Unlock()
+	d = receive(t, user.InputCh)
+	if ls, ok := d.Value.(ValLinkState); !ok || ls.Up {
+		t.Fatalf("unexpected %s", d)
+	}
+	d = receive(t, user.InputCh)
+	if ls, ok := d.Value.(ValLinkState); !ok || !ls.Up {
+		t.Fatalf("unexpected %s", d)
+	}
+	d = receive(t, user.InputCh)
+	if d.Value != Message("a") {
+		t.Fatalf("unexpected %s", d)
+	}
+}
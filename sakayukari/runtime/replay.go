@@ -1,36 +1,91 @@
 package runtime
 
-/*
-
 import (
-	"encoding/base64"
-	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	. "nyiyui.ca/hato/sakayukari"
 )
 
-// Replay sends the following values to the runtime.
-// If SerializedValue.Time is present in all values, they are sent at same time intervals between values.
-// If SerializedValue.Time is not present in all values, they are sent in the same order at unknown intervals.
-// If SerializedValue.Time is present in some but not all values, this function panics.
-func (i *Instance) Replay(values []SerializedValue) {
-	panic("not implemented yet")
-	timeCount := 0
-	for _, value := range values {
-		if values.Time {
-			timeCount++
-		}
-	}
-	if timeCount != 0 && timeCount != len(values) {
-		panic("SerializedValue.Time is present in some but not all values")
-	}
-	for i, sv := range values {
-		data, err := base64.StdEncoding.DecodeString(sv.Value)
+type ReplayConf struct {
+	// Timing, if true, keeps the original intervals between values. Otherwise, values are sent as fast as the destinations receive them (or, for LinearInput destinations, as fast as they are queued).
+	Timing bool
+	// Destinations, if not nil, maps actors in the trace to actors in the Instance's Graph. Values sent to actors not in Destinations are skipped.
+	// If nil, actors in the trace are used as-is.
+	Destinations map[ActorRef]ActorRef
+}
+
+// Replay sends recorded values to the actors they were originally sent to.
+// Replay does not run the Graph, so Diffuse should be running while replaying if the destinations output anything.
+// Values with types not registered (see RegisterValue) are skipped.
+// Values for LinearInput actors are queued with the values diffused by Diffuse, so the actors receive them in order.
+// Replay stops (and returns nil) when the Instance shuts down.
+func (i *Instance) Replay(svs []SerializedValue, conf ReplayConf) error {
+	var prev time.Time
+	for j, sv := range svs {
+		d, err := sv.Diffuse()
 		if err != nil {
-			t.Fatalf("value: base64 decode: %s", err)
+			log.Printf("sakayukari-runtime: replay: value %d: %s", j, err)
+			continue
+		}
+		if conf.Timing && !prev.IsZero() {
+			select {
+			case <-i.clock.After(sv.Time.Sub(prev)):
+			case <-i.stopped:
+				return nil
+			}
 		}
-		var d Diffuse1
-		if err := json.Unmarshal(data, &d); err != nil {
-			t.Fatalf("value: json decode: %s", err)
+		prev = sv.Time
+		for _, dest := range sv.Destinations {
+			ref := dest
+			if conf.Destinations != nil {
+				var ok bool
+				ref, ok = conf.Destinations[dest]
+				if !ok {
+					continue
+				}
+			}
+			err := i.checkInput(ref)
+			if err != nil {
+				return fmt.Errorf("value %d: %w", j, err)
+			}
+			if !i.track() {
+				return nil
+			}
+			if i.linear(ref.Index) {
+				i.queue(ref.Index).push(d)
+			} else {
+				i.send(ref.Index, &d)
+			}
+			i.sends.Done()
 		}
 	}
+	return nil
+}
+
+// track adds a send to sends, unless the Instance is shutting down.
+// Sends that do not happen in Diffuse's goroutine must be tracked, so shutdown does not close an InputCh before they are done.
+func (i *Instance) track() bool {
+	i.stopLock.Lock()
+	defer i.stopLock.Unlock()
+	select {
+	case <-i.stopped:
+		return false
+	default:
+	}
+	i.sends.Add(1)
+	return true
+}
+
+func (i *Instance) checkInput(ref ActorRef) error {
+	i.gLock.RLock()
+	defer i.gLock.RUnlock()
+	if ref.Index < 0 || ref.Index >= len(i.g.Actors) {
+		return fmt.Errorf("destination %s out of range", ref)
+	}
+	if !i.g.Actors[ref.Index].Type.Input {
+		return fmt.Errorf("destination %s %s is not an input actor", ref, i.g.Actors[ref.Index].Comment)
+	}
+	return nil
 }
-*/
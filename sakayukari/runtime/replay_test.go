@@ -0,0 +1,169 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/conn"
+)
+
+func TestReplay(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for _, v := range []Value{Message("a"), Message("b")} {
+		sv := serialize(&Diffuse1{Origin: ActorRef{Index: 1}, Value: v}, time.Now())
+		sv.Destinations = []ActorRef{{Index: 0}}
+		err := json.NewEncoder(buf).Encode(sv)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	svs, err := ReadTrace(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svs) != 2 {
+		t.Fatalf("got %d values", len(svs))
+	}
+	a := Actor{
+		InputCh: make(chan Diffuse1, 2),
+		Type:    ActorType{Input: true},
+	}
+	i := NewInstance(&Graph{Actors: []Actor{a}}, InstanceConf{})
+	err = i.Replay(svs, ReplayConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []Message{"a", "b"} {
+		d := <-a.InputCh
+		if d.Origin != (ActorRef{Index: 1}) {
+			t.Fatalf("origin mismatch: %s", d.Origin)
+		}
+		if d.Value != want {
+			t.Fatalf("value mismatch: %#v", d.Value)
+		}
+	}
+}
+
+func TestTraceReader(t *testing.T) {
+	buf := new(bytes.Buffer)
+	values := []Value{
+		conn.ValCurrent{Values: []conn.ValCurrentInner{{Line: "A", Flow: true}, {Line: "B"}}},
+		conn.ReqLine{Line: "A", Direction: true, Power: 100},
+		unregistered{},
+		conn.ValShortNotify{Line: "C", Monotonic: 16387},
+	}
+	for _, v := range values {
+		err := json.NewEncoder(buf).Encode(serialize(&Diffuse1{Origin: ActorRef{Index: 3}, Value: v}, time.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr, err := NewTraceReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []Value{values[0], values[1], values[3]} {
+		d, _, err := tr.NextDiffuse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(d.Value, want) {
+			t.Fatalf("diff: %s", cmp.Diff(d.Value, want))
+		}
+	}
+	_, _, err = tr.NextDiffuse()
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %s", err)
+	}
+}
+
+type unregistered struct{}
+
+func (_ unregistered) String() string { return "unregistered" }
+
+func TestReplayShutdown(t *testing.T) {
+	svs := make([]SerializedValue, 100)
+	for j := range svs {
+		svs[j] = *serialize(&Diffuse1{Origin: ActorRef{Index: 1}, Value: Message("a")}, time.Now())
+		svs[j].Destinations = []ActorRef{{Index: 0}}
+	}
+	a := Actor{
+		InputCh: make(chan Diffuse1),
+		Type:    ActorType{Input: true},
+	}
+	i := NewInstance(&Graph{Actors: []Actor{a}}, InstanceConf{})
+	ctx, cancel := context.WithCancel(context.Background())
+	diffused := make(chan struct{})
+	go func() {
+		defer close(diffused)
+		i.Diffuse(ctx)
+	}()
+	replayed := make(chan error)
+	go func() { replayed <- i.Replay(svs, ReplayConf{}) }()
+	// the actor is slow, so the replay is still running when shutting down
+	<-a.InputCh
+	cancel()
+	<-diffused
+	if err := <-replayed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayLinearOrder(t *testing.T) {
+	svs := make([]SerializedValue, 10)
+	for j := range svs {
+		svs[j] = *serialize(&Diffuse1{Origin: ActorRef{Index: 0}, Value: Message(fmt.Sprint(j))}, time.Now())
+		svs[j].Destinations = []ActorRef{{Index: 1}}
+	}
+	src := Actor{
+		Comment:  "src",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}
+	dst := Actor{
+		Comment: "dst",
+		InputCh: make(chan Diffuse1),
+		Inputs:  []ActorRef{{Index: 0}},
+		Type:    ActorType{Input: true, LinearInput: true},
+	}
+	// marker's output is received by Diffuse after it queued src's outputs
+	marker := Actor{
+		Comment:  "marker",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}
+	i := NewInstance(&Graph{Actors: []Actor{src, dst, marker}}, InstanceConf{Trace: TraceConf{Disabled: true}})
+	err := i.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go i.Diffuse(ctx)
+	src.OutputCh <- Diffuse1{Value: Message("live a")}
+	src.OutputCh <- Diffuse1{Value: Message("live b")}
+	marker.OutputCh <- Diffuse1{Value: Message("marker")}
+	replayed := make(chan error)
+	go func() { replayed <- i.Replay(svs, ReplayConf{}) }()
+	// dst is slow, so the replay starts while "live a" is being delivered
+	time.Sleep(10 * time.Millisecond)
+	want := []Message{"live a", "live b"}
+	for j := range svs {
+		want = append(want, Message(fmt.Sprint(j)))
+	}
+	for _, w := range want {
+		if d := <-dst.InputCh; d.Value != w {
+			t.Fatalf("got %s, want %s", d.Value, w)
+		}
+	}
+	if err := <-replayed; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+package runtime
+
+import (
+	"log"
+	"reflect"
+	"time"
+)
+
+// DefaultShutdownTimeout is used when InstanceConf.ShutdownTimeout is 0.
+const DefaultShutdownTimeout = 3 * time.Second
+
+// shutdown stops delivering diffuses, and closes the InputCh of every actor, dependents first.
+// After closing an actor's InputCh, the actor's Done (if not nil) is waited on, so e.g. hardware actors can turn off outputs before the actors they depend on are closed.
+// Diffuses sent by actors while shutting down are discarded.
+func (i *Instance) shutdown() {
+	log.Printf("sakayukari-runtime: shutting down")
+	i.stopLock.Lock()
+	close(i.stopped)
+	i.stopLock.Unlock()
+	i.queuesLock.Lock()
+	for _, q := range i.queues {
+		q.close()
+	}
+	i.queuesLock.Unlock()
+	i.sends.Wait()
+
+	i.gLock.RLock()
+	defer i.gLock.RUnlock()
+	drainDone := make(chan struct{})
+	defer close(drainDone)
+	go i.drain(drainDone)
+
+	timeout := i.conf.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	for _, j := range i.closeOrder() {
+		actor := i.g.Actors[j]
+		if !actor.Type.Input {
+			continue
+		}
+		close(actor.InputCh)
+		if actor.Done == nil {
+			continue
+		}
+		select {
+		case <-actor.Done:
+		case <-time.After(timeout):
+			// not i.clock, as a virtual clock may never advance while shutting down
+			log.Printf("sakayukari-runtime: actor %d %s did not finish within %s", j, actor.Comment, timeout)
+		}
+	}
+	log.Printf("sakayukari-runtime: shut down")
+}
+
+// drain receives and discards diffuses from all actors until done is closed.
+// gLock must be taken.
+func (i *Instance) drain(done <-chan struct{}) {
+	cases := []reflect.SelectCase{{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(done),
+	}}
+	for _, actor := range i.g.Actors {
+		if actor.Type.Output {
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(actor.OutputCh),
+			})
+		}
+	}
+	for {
+		chosen, _, _ := reflect.Select(cases)
+		if chosen == 0 {
+			return
+		}
+	}
+}
+
+// closeOrder returns the indices of all actors, so that every actor comes after all of its dependents.
+// Actors in a cycle are ordered arbitrarily.
+// gLock must be taken.
+func (i *Instance) closeOrder() []int {
+	order := make([]int, 0, len(i.g.Actors))
+	visited := make([]bool, len(i.g.Actors))
+	var visit func(j int)
+	visit = func(j int) {
+		if visited[j] {
+			return
+		}
+		visited[j] = true
+		for _, k := range i.dependsOn[j] {
+			visit(k)
+		}
+		order = append(order, j)
+	}
+	for j := range i.g.Actors {
+		visit(j)
+	}
+	return order
+}
@@ -0,0 +1,150 @@
+package runtime
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultTracePath is the prefix of trace files if TraceConf.Path is empty.
+var DefaultTracePath = filepath.Join(os.TempDir(), "hato-sakayukari-trace-record")
+
+type TraceConf struct {
+	// Disabled disables recording traces.
+	Disabled bool
+	// Writer, if not nil, is where the trace is written to. Path, PerSession, and MaxSize are ignored.
+	Writer io.Writer
+	// Path is the file the trace is written to.
+	// If empty, DefaultTracePath is used with PerSession.
+	Path string
+	// PerSession, if true, appends the time the trace was started to Path, so traces of previous sessions are not overwritten.
+	PerSession bool
+	// MaxSize, if not 0, is the size in bytes after which the trace file is rotated.
+	// Rotated files have a sequence number appended (e.g. trace.1, trace.2, …).
+	MaxSize int64
+	// Gzip compresses the trace. If writing to a file, ".gz" is appended to its name.
+	Gzip bool
+}
+
+// traceSink writes a trace according to a TraceConf.
+// Each Write must contain whole values, as rotation only happens between Writes.
+type traceSink struct {
+	conf TraceConf
+	base string
+	seq  int
+	f    *os.File
+	cw   *countingWriter
+	gz   *gzip.Writer
+	w    io.Writer
+}
+
+func newTraceSink(conf TraceConf, start time.Time) (*traceSink, error) {
+	s := &traceSink{conf: conf}
+	if conf.Writer != nil {
+		s.cw = &countingWriter{w: conf.Writer}
+		s.wrap()
+		return s, nil
+	}
+	s.base = conf.Path
+	if s.base == "" {
+		s.base = DefaultTracePath
+		s.conf.PerSession = true
+	}
+	if s.conf.PerSession {
+		s.base = fmt.Sprintf("%s-%s", s.base, start.Format("20060102-150405"))
+	}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Name returns the name of the file currently written to, or an empty string if not writing to a file.
+func (s *traceSink) Name() string {
+	if s.f == nil {
+		return ""
+	}
+	return s.f.Name()
+}
+
+func (s *traceSink) open() error {
+	name := s.base
+	if s.seq != 0 {
+		name = fmt.Sprintf("%s.%d", name, s.seq)
+	}
+	if s.conf.Gzip {
+		name += ".gz"
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.cw = &countingWriter{w: f}
+	s.wrap()
+	return nil
+}
+
+func (s *traceSink) wrap() {
+	if s.conf.Gzip {
+		s.gz = gzip.NewWriter(s.cw)
+		s.w = s.gz
+	} else {
+		s.w = s.cw
+	}
+}
+
+func (s *traceSink) rotate() error {
+	err := s.Close()
+	if err != nil {
+		return err
+	}
+	s.seq++
+	return s.open()
+}
+
+func (s *traceSink) Write(p []byte) (n int, err error) {
+	if s.f != nil && s.conf.MaxSize != 0 && s.cw.n >= s.conf.MaxSize {
+		err = s.rotate()
+		if err != nil {
+			return 0, fmt.Errorf("rotate: %w", err)
+		}
+	}
+	n, err = s.w.Write(p)
+	if err != nil {
+		return
+	}
+	if s.gz != nil {
+		// flush so that the size is known for rotation, and so that the trace is readable if we crash
+		err = s.gz.Flush()
+	}
+	return
+}
+
+func (s *traceSink) Close() error {
+	if s.gz != nil {
+		err := s.gz.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if s.f != nil {
+		return s.f.Close()
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return
+}
@@ -0,0 +1,42 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTraceSinkRotate(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "trace")
+	s, err := newTraceSink(TraceConf{Path: base, MaxSize: 10, Gzip: true}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(`{"Type":"sakayukari.Message","Value":"a"}` + "\n")
+	for j := 0; j < 3; j++ {
+		_, err = s.Write(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"trace.gz", "trace.1.gz", "trace.2.gz"} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		svs, err := ReadTrace(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if len(svs) != 1 {
+			t.Fatalf("%s: got %d values", name, len(svs))
+		}
+	}
+}
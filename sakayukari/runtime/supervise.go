@@ -0,0 +1,209 @@
+package runtime
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	. "nyiyui.ca/hato/sakayukari"
+)
+
+// HangPolicy is what the runtime does when an actor does not receive a diffuse within its deadline.
+type HangPolicy int
+
+const (
+	// HangPolicyLog reports the hang, and keeps waiting for the actor.
+	HangPolicyLog HangPolicy = iota
+	// HangPolicyDrop reports the hang, and drops the pending diffuse.
+	HangPolicyDrop
+	// HangPolicyRestart reports the hang, replaces the actor with one made by Supervision.Restart, and delivers the pending diffuse to the new actor.
+	// If the new actor also hangs on the pending diffuse, the diffuse is dropped instead of restarting again.
+	HangPolicyRestart
+	// HangPolicyEmergencyStop reports the hang, calls InstanceConf.EmergencyStop, and keeps waiting for the actor.
+	HangPolicyEmergencyStop
+)
+
+func (p HangPolicy) String() string {
+	switch p {
+	case HangPolicyLog:
+		return "log"
+	case HangPolicyDrop:
+		return "drop"
+	case HangPolicyRestart:
+		return "restart"
+	case HangPolicyEmergencyStop:
+		return "emergency-stop"
+	default:
+		return fmt.Sprintf("HangPolicy unknown %d", p)
+	}
+}
+
+type Supervision struct {
+	// Deadline is how long delivering a single diffuse to the actor can take before the actor is considered hung.
+	// If 0, there is no deadline.
+	Deadline time.Duration
+	Policy   HangPolicy
+	// Restart returns a new actor to replace the hung actor. This is required for HangPolicyRestart.
+	// The Inputs of the old actor are kept if the new actor's Inputs is nil.
+	Restart func() Actor
+}
+
+// Hang is a report of an actor not receiving a diffuse within its deadline.
+type Hang struct {
+	Actor   ActorRef
+	Comment string
+	Pending Diffuse1
+	// Since is when the runtime started delivering Pending.
+	Since  time.Time
+	Policy HangPolicy
+}
+
+func (h Hang) String() string {
+	return fmt.Sprintf("actor %s %s hung since %s (policy %s): pending %s from %s", h.Actor, h.Comment, h.Since.Format(time.RFC3339Nano), h.Policy, h.Pending.Value, h.Pending.Origin)
+}
+
+// ActorStats are counters for a single actor.
+type ActorStats struct {
+	Actor   ActorRef
+	Comment string
+	// Emitted is the number of diffuses received from the actor's OutputCh.
+	Emitted uint64
+	// Delivered is the number of diffuses sent to the actor's InputCh.
+	Delivered uint64
+	// Pending is the number of diffuses queued for a LinearInput actor.
+	Pending   int
+	Hangs     uint64
+	Dropped   uint64
+	Restarted uint64
+}
+
+type actorCounters struct {
+	emitted   atomic.Uint64
+	delivered atomic.Uint64
+	hangs     atomic.Uint64
+	dropped   atomic.Uint64
+	restarted atomic.Uint64
+	// sendLatency is the time taken to send to the actor's InputCh.
+	sendLatency histogram
+}
+
+// Stats returns counters for every actor.
+func (i *Instance) Stats() []ActorStats {
+	i.gLock.RLock()
+	defer i.gLock.RUnlock()
+	res := make([]ActorStats, len(i.g.Actors))
+	for j, actor := range i.g.Actors {
+		c := &i.counters[j]
+		res[j] = ActorStats{
+			Actor:     ActorRef{Index: j},
+			Comment:   actor.Comment,
+			Emitted:   c.emitted.Load(),
+			Delivered: c.delivered.Load(),
+			Hangs:     c.hangs.Load(),
+			Dropped:   c.dropped.Load(),
+			Restarted: c.restarted.Load(),
+		}
+		i.queuesLock.Lock()
+		q, ok := i.queues[j]
+		i.queuesLock.Unlock()
+		if ok {
+			res[j].Pending = q.Len()
+		}
+	}
+	return res
+}
+
+// supervision returns the Supervision for the actor actorI.
+func (i *Instance) supervision(actorI int) Supervision {
+	sup, ok := i.conf.ActorSupervision[ActorRef{Index: actorI}]
+	if !ok {
+		sup = i.conf.Supervision
+	}
+	return sup
+}
+
+// hung reports a hang.
+func (i *Instance) hung(h Hang) {
+	i.counters[h.Actor.Index].hangs.Add(1)
+	log.Printf("sakayukari-runtime: %s", h)
+	i.hangMuxS.Send(h)
+}
+
+// send sends d to the actor actorI, blocking until the actor receives it, or the actor's Supervision decides otherwise.
+func (i *Instance) send(actorI int, d *Diffuse1) {
+	i.sendSupervised(actorI, d, false)
+}
+
+// sendSupervised is send; restarted is true if the actor was already restarted while sending d.
+func (i *Instance) sendSupervised(actorI int, d *Diffuse1, restarted bool) {
+	i.gLock.RLock()
+	actor := i.g.Actors[actorI]
+	i.gLock.RUnlock()
+	sup := i.supervision(actorI)
+	since := i.clock.Now()
+	if sup.Deadline == 0 {
+		i.sendWait(actorI, actor.InputCh, d, since)
+		return
+	}
+	timer := i.clock.NewTimer(sup.Deadline)
+	select {
+	case actor.InputCh <- *d:
+		timer.Stop()
+		i.delivered(actorI, d, since)
+		return
+	case <-i.stopped:
+		timer.Stop()
+		return
+	case <-timer.C:
+	}
+	i.hung(Hang{
+		Actor:   ActorRef{Index: actorI},
+		Comment: actor.Comment,
+		Pending: *d,
+		Since:   since,
+		Policy:  sup.Policy,
+	})
+	switch sup.Policy {
+	case HangPolicyDrop:
+		i.counters[actorI].dropped.Add(1)
+		return
+	case HangPolicyRestart:
+		if restarted {
+			log.Printf("sakayukari-runtime: actor %s %s: hung again after restart; dropping", ActorRef{Index: actorI}, actor.Comment)
+			i.counters[actorI].dropped.Add(1)
+			return
+		}
+		if sup.Restart == nil {
+			log.Printf("sakayukari-runtime: actor %s %s: no Restart; dropping", ActorRef{Index: actorI}, actor.Comment)
+			i.counters[actorI].dropped.Add(1)
+			return
+		}
+		err := i.ReplaceActor(ActorRef{Index: actorI}, sup.Restart())
+		if err != nil {
+			log.Printf("sakayukari-runtime: actor %s %s: restart: %s; dropping", ActorRef{Index: actorI}, actor.Comment, err)
+			i.counters[actorI].dropped.Add(1)
+			return
+		}
+		i.counters[actorI].restarted.Add(1)
+		i.sendSupervised(actorI, d, true)
+		return
+	case HangPolicyEmergencyStop:
+		if i.conf.EmergencyStop != nil {
+			i.conf.EmergencyStop(ActorRef{Index: actorI})
+		} else {
+			log.Printf("sakayukari-runtime: actor %s %s: no EmergencyStop set", ActorRef{Index: actorI}, actor.Comment)
+		}
+	}
+	i.sendWait(actorI, actor.InputCh, d, since)
+}
+
+// sendWait sends d to ch (the InputCh of the actor actorI), until the actor receives it or the Instance shuts down.
+// since is when sending started.
+func (i *Instance) sendWait(actorI int, ch chan Diffuse1, d *Diffuse1, since time.Time) {
+	select {
+	case ch <- *d:
+		i.delivered(actorI, d, since)
+	case <-i.stopped:
+	}
+}
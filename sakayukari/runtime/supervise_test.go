@@ -0,0 +1,187 @@
+package runtime
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/clock"
+)
+
+func TestSupervisionRestart(t *testing.T) {
+	src := Actor{
+		Comment:  "src",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}
+	hung := Actor{
+		Comment: "hung",
+		InputCh: make(chan Diffuse1),
+		Inputs:  []ActorRef{{Index: 0}},
+		Type:    ActorType{Input: true, LinearInput: true},
+	}
+	restarted := Actor{
+		Comment: "restarted",
+		InputCh: make(chan Diffuse1),
+		Type:    ActorType{Input: true, LinearInput: true},
+	}
+	g := Graph{Actors: []Actor{src, hung}}
+	i := NewInstance(&g, InstanceConf{
+		Trace: TraceConf{Disabled: true},
+		ActorSupervision: map[ActorRef]Supervision{
+			{Index: 1}: {
+				Deadline: 10 * time.Millisecond,
+				Policy:   HangPolicyRestart,
+				Restart:  func() Actor { return restarted },
+			},
+		},
+	})
+	err := i.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hangs := make(chan Hang, 1)
+	i.HangMux.Subscribe("test", hangs)
+	go i.Diffuse(context.Background())
+	src.OutputCh <- Diffuse1{Value: Message("a")}
+	d := <-restarted.InputCh
+	if d.Value != Message("a") {
+		t.Fatalf("unexpected %s", d)
+	}
+	h := <-hangs
+	if h.Actor != (ActorRef{Index: 1}) || h.Comment != "hung" || h.Pending.Value != Message("a") {
+		t.Fatalf("unexpected hang %s", h)
+	}
+	stats := i.Stats()[1]
+	if stats.Hangs != 1 || stats.Restarted != 1 || stats.Delivered != 1 || stats.Comment != "restarted" {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+}
+
+func TestSupervisionRestartHungAgain(t *testing.T) {
+	src := Actor{
+		Comment:  "src",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}
+	hung := Actor{
+		Comment: "hung",
+		InputCh: make(chan Diffuse1),
+		Inputs:  []ActorRef{{Index: 0}},
+		Type:    ActorType{Input: true, LinearInput: true},
+	}
+	restarts := 0
+	g := Graph{Actors: []Actor{src, hung}}
+	i := NewInstance(&g, InstanceConf{
+		Trace: TraceConf{Disabled: true},
+		ActorSupervision: map[ActorRef]Supervision{
+			{Index: 1}: {
+				Deadline: 10 * time.Millisecond,
+				Policy:   HangPolicyRestart,
+				Restart: func() Actor {
+					restarts++
+					return Actor{
+						Comment: "restarted",
+						InputCh: make(chan Diffuse1),
+						Type:    ActorType{Input: true, LinearInput: true},
+					}
+				},
+			},
+		},
+	})
+	err := i.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go i.Diffuse(context.Background())
+	src.OutputCh <- Diffuse1{Value: Message("a")}
+	deadline := time.Now().Add(time.Second)
+	for i.Stats()[1].Dropped != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats %#v", i.Stats()[1])
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stats := i.Stats()[1]
+	if stats.Hangs != 2 || stats.Restarted != 1 || restarts != 1 {
+		t.Fatalf("unexpected stats %#v (%d restarts)", stats, restarts)
+	}
+}
+
+func TestSupervisionDrop(t *testing.T) {
+	src := Actor{
+		Comment:  "src",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}
+	hung := Actor{
+		Comment: "hung",
+		InputCh: make(chan Diffuse1),
+		Inputs:  []ActorRef{{Index: 0}},
+		Type:    ActorType{Input: true, LinearInput: true},
+	}
+	g := Graph{Actors: []Actor{src, hung}}
+	i := NewInstance(&g, InstanceConf{
+		Trace:       TraceConf{Disabled: true},
+		Supervision: Supervision{Deadline: 10 * time.Millisecond, Policy: HangPolicyDrop},
+	})
+	err := i.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go i.Diffuse(context.Background())
+	src.OutputCh <- Diffuse1{Value: Message("a")}
+	src.OutputCh <- Diffuse1{Value: Message("b")}
+	deadline := time.Now().Add(time.Second)
+	for i.Stats()[1].Dropped != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats %#v", i.Stats()[1])
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the actor is not hung anymore
+	src.OutputCh <- Diffuse1{Value: Message("c")}
+	if d := <-hung.InputCh; d.Value != Message("c") {
+		t.Fatalf("unexpected %s", d)
+	}
+}
+
+func TestSupervisionVirtualClock(t *testing.T) {
+	src := Actor{
+		Comment:  "src",
+		OutputCh: make(chan Diffuse1),
+		Type:     ActorType{Output: true},
+	}
+	hung := Actor{
+		Comment: "hung",
+		InputCh: make(chan Diffuse1),
+		Inputs:  []ActorRef{{Index: 0}},
+		Type:    ActorType{Input: true, LinearInput: true},
+	}
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewVirtual(start)
+	g := Graph{Actors: []Actor{src, hung}}
+	i := NewInstance(&g, InstanceConf{
+		Trace:       TraceConf{Disabled: true},
+		Clock:       c,
+		Supervision: Supervision{Deadline: time.Hour, Policy: HangPolicyDrop},
+	})
+	err := i.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hangs := make(chan Hang, 1)
+	i.HangMux.Subscribe("test", hangs)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go i.Diffuse(ctx)
+	src.OutputCh <- Diffuse1{Value: Message("a")}
+	// wait for the deadline timer
+	c.BlockUntil(1)
+	c.Advance(time.Hour)
+	h := <-hangs
+	if !h.Since.Equal(start) || h.Pending.Value != Message("a") {
+		t.Fatalf("unexpected hang %s", h)
+	}
+}
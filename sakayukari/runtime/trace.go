@@ -1,49 +1,165 @@
 package runtime
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
+	"sync"
 	"time"
 
 	. "nyiyui.ca/hato/sakayukari"
 )
 
+// SerializedValue is a single Diffuse1 recorded in a trace.
+// A trace is a stream of JSON-encoded SerializedValues.
 type SerializedValue struct {
-	Preview      string
-	Value        []byte
-	Destinations []int
-	Time         time.Time
+	Time    time.Time
+	Preview string
+	// Type is the name the value's type was registered under (see RegisterValue). If empty, Value cannot be decoded.
+	Type  string
+	Value json.RawMessage
+	// Origin is the actor that sent this value (i.e. the Origin of the Diffuse1 as delivered to Destinations).
+	Origin ActorRef
+	// Comment is the Comment of Origin.
+	Comment string
+	// Destinations are the actors this value was delivered to.
+	Destinations []ActorRef
+	// DestinationComments are the Comments of Destinations, in the same order.
+	DestinationComments []string
 }
 
-// serialize tries to serialize as much as it can of v.
-func serialize(v interface{}) (sv *SerializedValue) {
+// serialize tries to serialize as much as it can of d.
+func serialize(d *Diffuse1, now time.Time) (sv *SerializedValue) {
 	sv = new(SerializedValue)
-	sv.Time = time.Now()
-	sv.Preview = fmt.Sprintf("%#v", v)
-	var err error
-	buf := new(bytes.Buffer)
-	err = json.NewEncoder(buf).Encode(v)
-	if err == nil {
-		sv.Value = buf.Bytes()
+	sv.Time = now
+	sv.Preview = fmt.Sprintf("%#v", d.Value)
+	sv.Origin = d.Origin
+	name, ok := ValueName(d.Value)
+	if !ok {
+		warnUnregistered(d.Value)
+		return
+	}
+	data, err := json.Marshal(d.Value)
+	if err != nil {
 		return
 	}
+	sv.Type = name
+	sv.Value = data
 	return
 }
 
+// Diffuse decodes sv into a Diffuse1.
+func (sv *SerializedValue) Diffuse() (Diffuse1, error) {
+	if sv.Type == "" {
+		return Diffuse1{}, fmt.Errorf("value has no type: %s", sv.Preview)
+	}
+	v, err := DecodeValue(sv.Type, sv.Value)
+	if err != nil {
+		return Diffuse1{}, err
+	}
+	return Diffuse1{Origin: sv.Origin, Value: v}, nil
+}
+
+var unregisteredWarned sync.Map
+
+func warnUnregistered(v Value) {
+	name := fmt.Sprintf("%T", v)
+	if _, loaded := unregisteredWarned.LoadOrStore(name, struct{}{}); !loaded {
+		log.Printf("sakayukari-runtime: trace: value type %s not registered; it will not be decodable", name)
+	}
+}
+
+// TraceReader reads values from a trace.
+type TraceReader struct {
+	dec *json.Decoder
+	n   int
+}
+
+// NewTraceReader returns a TraceReader reading from r. Gzip-compressed traces are decompressed transparently.
+func NewTraceReader(r io.Reader) (*TraceReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		return &TraceReader{dec: json.NewDecoder(gr)}, nil
+	}
+	return &TraceReader{dec: json.NewDecoder(br)}, nil
+}
+
+// Next returns the next recorded value. If there are no more values, it returns io.EOF.
+func (tr *TraceReader) Next() (*SerializedValue, error) {
+	sv := new(SerializedValue)
+	err := tr.dec.Decode(sv)
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, fmt.Errorf("value %d: %w", tr.n, err)
+	}
+	tr.n++
+	return sv, nil
+}
+
+// NextDiffuse returns the next recorded value that can be decoded, along with the decoded Diffuse1.
+// Values that cannot be decoded (e.g. their type was not registered) are skipped.
+// If there are no more values, it returns io.EOF.
+func (tr *TraceReader) NextDiffuse() (Diffuse1, *SerializedValue, error) {
+	for {
+		sv, err := tr.Next()
+		if err != nil {
+			return Diffuse1{}, nil, err
+		}
+		if sv.Type == "" {
+			continue
+		}
+		d, err := sv.Diffuse()
+		if err != nil {
+			return Diffuse1{}, sv, fmt.Errorf("value %d: %w", tr.n-1, err)
+		}
+		return d, sv, nil
+	}
+}
+
+// ReadTrace reads all values recorded in a trace.
+func ReadTrace(r io.Reader) ([]SerializedValue, error) {
+	svs := make([]SerializedValue, 0)
+	tr, err := NewTraceReader(r)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		sv, err := tr.Next()
+		if err == io.EOF {
+			return svs, nil
+		} else if err != nil {
+			return svs, err
+		}
+		svs = append(svs, *sv)
+	}
+}
+
 func (i *Instance) initRecord() error {
 	if i.traceOutput != nil {
 		return errors.New("sakayukari-runtime: trace: init: already inited")
 	}
-	f, err := os.Create("/tmp/hato-sakayukari-trace-record")
+	if i.conf.Trace.Disabled {
+		return nil
+	}
+	s, err := newTraceSink(i.conf.Trace, i.clock.Now())
 	if err != nil {
 		return err
 	}
-	i.traceOutput = f
+	if name := s.Name(); name != "" {
+		log.Printf("sakayukari-runtime: trace: recording to %s", name)
+	}
+	i.traceOutput = s
 	return nil
 }
 
@@ -51,19 +167,31 @@ func (i *Instance) record(d *Diffuse1, dests []int) {
 	if i.traceOutput == nil {
 		return
 	}
+	sv := serialize(d, i.clock.Now())
+	sv.Destinations = make([]ActorRef, len(dests))
+	sv.DestinationComments = make([]string, len(dests))
+	func() {
+		i.gLock.RLock()
+		defer i.gLock.RUnlock()
+		if d.Origin.Index >= 0 && d.Origin.Index < len(i.g.Actors) {
+			sv.Comment = i.g.Actors[d.Origin.Index].Comment
+		}
+		for j, dest := range dests {
+			sv.Destinations[j] = ActorRef{Index: dest}
+			sv.DestinationComments[j] = i.g.Actors[dest].Comment
+		}
+	}()
 	i.traceLock.Lock()
 	defer i.traceLock.Unlock()
-	sv := serialize(d)
-	sv.Destinations = dests
 	buf := new(bytes.Buffer)
 	err := json.NewEncoder(buf).Encode(sv)
 	if err != nil {
 		log.Printf("sakayukari-runtime: trace: record (encode) %#v: %s", d, err)
 		return
 	}
-	_, err = io.Copy(i.traceOutput, buf)
+	_, err = i.traceOutput.Write(buf.Bytes())
 	if err != nil {
-		log.Printf("sakayukari-runtime: trace: record (copy) %#v: %s", d, err)
+		log.Printf("sakayukari-runtime: trace: record (write) %#v: %s", d, err)
 		return
 	}
 }
@@ -21,6 +21,8 @@ type Conf struct {
 	Guide  ActorRef
 	Model  ActorRef
 	Guide2 *tal.Guide
+	// Stopper sends emergency stops to Guide. If nil, they are sent from the sakuragi actor.
+	Stopper *tal.EmergencyStopper
 }
 
 type sakuragi struct {
@@ -150,8 +152,36 @@ func (s *sakuragi) handleIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *sakuragi) handleEmergency(reset bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		es := tal.GuideEmergencyStop{Reset: reset}
+		var err error
+		if s.conf.Stopper != nil {
+			err = s.conf.Stopper.Send(r.Context(), es)
+		} else {
+			select {
+			case s.actor.OutputCh <- Diffuse1{Origin: s.conf.Guide, Value: es}:
+			case <-r.Context().Done():
+				err = r.Context().Err()
+			}
+		}
+		if err != nil {
+			log.Printf("sakuragi: %s: %s", es, err)
+			http.Error(w, "emergency stop not delivered: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
 func (s *sakuragi) setup() {
 	s.sm.HandleFunc("/", s.handleIndex)
+	s.sm.HandleFunc("/emergency-stop", s.handleEmergency(false))
+	s.sm.HandleFunc("/emergency-reset", s.handleEmergency(true))
 	go func() {
 		err := http.ListenAndServe("0.0.0.0:8080", s.sm)
 		log.Fatalf("sakuragi: %s", err)
@@ -2,6 +2,7 @@ package tal
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 	"go.uber.org/zap"
 	"golang.org/x/exp/slices"
 	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/clock"
 	"nyiyui.ca/hato/sakayukari/conn"
 	"nyiyui.ca/hato/sakayukari/notify"
 	. "nyiyui.ca/hato/sakayukari/prelude"
@@ -21,6 +23,14 @@ import (
 	"nyiyui.ca/hato/sakayukari/tal/layout"
 )
 
+func init() {
+	RegisterValue("tal.GuideTrainUpdate", GuideTrainUpdate{})
+	RegisterValue("tal.GuideSnapshot", GuideSnapshot{})
+	RegisterValue("tal.GuideChange", GuideChange{})
+	RegisterValue("tal.GuideEmergencyStop", GuideEmergencyStop{})
+	RegisterValue("tal.Attitude", Attitude{})
+}
+
 const idlePower = 10
 
 type LineID = layout.LineID
@@ -33,7 +43,12 @@ type GuideConf struct {
 	Model         ActorRef
 	Actors        map[LineID]ActorRef
 	actorsReverse map[ActorRef]conn.Id
-	Cars          cars.Data
+	// Clock is used for train histories, the model and the simulator. If nil, clock.Real is used.
+	Clock clock.Clock
+	// Links are actors publishing ValLinkState for links to remote actors in Actors.
+	// Lines with a remote actor are marked as Lost when the link is down.
+	Links []ActorRef
+	Cars  cars.Data
 	// Virtual disables serial commands to lines.
 	Virtual  bool
 	DontDemo bool
@@ -199,6 +214,21 @@ type Guide struct {
 	changeMuxS   *notify.MultiplexerSender[GuideChange]
 	ChangeMux    *notify.Multiplexer[GuideChange]
 	Model2       *Model2
+	clock        clock.Clock
+	// linksDown and connsDown have actors unreachable due to a link (to a remote actor) or a device being down, respectively.
+	linksDown map[ActorRef]bool
+	connsDown map[ActorRef]bool
+	// connsHung has actors of devices that stopped replying to heartbeats (and so may have turned off their lines).
+	connsHung map[ActorRef]bool
+	// emergency is true from a GuideEmergencyStop until it is reset.
+	emergency bool
+	// actorsLock guards conf.Actors and conf.actorsReverse, which RemakeActor replaces.
+	actorsLock sync.RWMutex
+}
+
+// Clock returns the clock used by g (see GuideConf.Clock).
+func (g *Guide) Clock() clock.Clock {
+	return g.clock
 }
 
 type LineStates struct {
@@ -209,14 +239,21 @@ type LineStates struct {
 	SwitchActor     ActorRef
 	SwitchState     SwitchState
 	nextSwitchState SwitchState
+	// Lost is true when PowerActor or SwitchActor is unreachable (e.g. a link to a remote actor is down, or the device is disconnected or misses heartbeats).
+	// Trains do not run on lost lines.
+	Lost bool
 }
 
+// RemakeActor returns an Actor with Inputs for actors.
+// The channels of the Actor are reused (if already made), so the returned Actor can replace the old one in a running runtime.
 func (g *Guide) RemakeActor(actors map[LineID]ActorRef) Actor {
+	g.actorsLock.Lock()
+	defer g.actorsLock.Unlock()
 	g.conf.Actors = actors
 	a := Actor{
 		Comment:  "tal-guide",
-		InputCh:  make(chan Diffuse1),
-		OutputCh: make(chan Diffuse1),
+		InputCh:  g.actor.InputCh,
+		OutputCh: g.actor.OutputCh,
 		Inputs:   make([]ActorRef, 0),
 		Type: ActorType{
 			Input:       true,
@@ -224,7 +261,12 @@ func (g *Guide) RemakeActor(actors map[LineID]ActorRef) Actor {
 			Output:      true,
 		},
 	}
+	if a.InputCh == nil {
+		a.InputCh = make(chan Diffuse1)
+		a.OutputCh = make(chan Diffuse1)
+	}
 	a.Inputs = append(a.Inputs, g.conf.Model)
+	a.Inputs = append(a.Inputs, g.conf.Links...)
 	for _, l := range g.conf.Layout.Lines {
 		a.Inputs = append(a.Inputs, g.conf.Actors[l.PowerConn])
 		if l.IsSwitch() {
@@ -239,6 +281,21 @@ func (g *Guide) RemakeActor(actors map[LineID]ActorRef) Actor {
 	return a
 }
 
+// lineActor returns the actor of the device line id.
+func (g *Guide) lineActor(id LineID) ActorRef {
+	g.actorsLock.RLock()
+	defer g.actorsLock.RUnlock()
+	return g.conf.Actors[id]
+}
+
+// actorConn returns the device of the actor ref.
+func (g *Guide) actorConn(ref ActorRef) (conn.Id, bool) {
+	g.actorsLock.RLock()
+	defer g.actorsLock.RUnlock()
+	c, ok := g.conf.actorsReverse[ref]
+	return c, ok
+}
+
 func NewGuide(conf GuideConf) (*Guide, Actor) {
 	if conf.Cars.Forms == nil {
 		panic("conf.Cars required")
@@ -248,6 +305,10 @@ func NewGuide(conf GuideConf) (*Guide, Actor) {
 		trains:     make([]Train, 0),
 		lineStates: make([]LineStates, len(conf.Layout.Lines)),
 		Layout:     conf.Layout,
+		clock:      clock.Or(conf.Clock),
+		linksDown:  map[ActorRef]bool{},
+		connsDown:  map[ActorRef]bool{},
+		connsHung:  map[ActorRef]bool{},
 	}
 	g.RemakeActor(conf.Actors)
 	var err error
@@ -427,7 +488,7 @@ func (g *Guide) calculateTrailers(t *Train) {
 }
 
 func (g *Guide) handleValCurrent(diffuse Diffuse1, cur conn.ValCurrent) {
-	ci, ok := g.conf.actorsReverse[diffuse.Origin]
+	ci, ok := g.actorConn(diffuse.Origin)
 	if !ok {
 		log.Printf("unknown conn for actor %s", diffuse.Origin)
 		return
@@ -502,6 +563,111 @@ func (g *Guide) handleValCurrent(diffuse Diffuse1, cur conn.ValCurrent) {
 	g.publishSnapshot()
 }
 
+// handleLinkState marks lines with actors behind the link as lost (or not lost), and wakes up all trains so trains on lost lines stop.
+func (g *Guide) handleLinkState(ls ValLinkState) {
+	for _, ref := range ls.Actors {
+		g.linksDown[ref] = !ls.Up
+	}
+	log.Printf("=== %s", ls)
+	g.updateLost("link state")
+}
+
+// handleCommandFailed wakes up the train taking the line of a command that was not applied, so the command is sent again.
+// A failed switch may or may not have moved, so its state becomes unknown (instead of staying SwitchStateUnsafe forever).
+func (g *Guide) handleCommandFailed(origin ActorRef, cf conn.ValCommandFailed) {
+	c, ok := g.actorConn(origin)
+	if !ok {
+		zap.S().Errorf("no conn for actor %s", origin)
+		return
+	}
+	log.Printf("=== %s", cf)
+	var li int
+	if cf.ReqSwitch != nil {
+		li = slices.IndexFunc(g.Layout.Lines, func(l layout.Line) bool { return l.SwitchConn == (LineID{Conn: c, Line: cf.ReqSwitch.Line}) })
+	} else {
+		li = slices.IndexFunc(g.Layout.Lines, func(l layout.Line) bool { return l.PowerConn == (LineID{Conn: c, Line: cf.ReqLine.Line}) })
+	}
+	if li == -1 {
+		zap.S().Errorf("no line found for %s (conn = %s)", cf, c)
+		return
+	}
+	if g.emergency && cf.ReqLine != nil {
+		g.brake(li)
+		return
+	}
+	if cf.ReqSwitch != nil && g.lineStates[li].SwitchState == SwitchStateUnsafe {
+		g.lineStates[li].SwitchState = 0
+		g.lineStates[li].nextSwitchState = 0
+	}
+	ls := g.lineStates[li]
+	if ls.Taken {
+		g.wakeup(ls.TakenBy, "ValCommandFailed")
+	}
+}
+
+// handleConnState marks lines with the origin actor as lost (or not lost), and wakes up all trains so trains on lost lines stop.
+func (g *Guide) handleConnState(origin ActorRef, cs conn.ValConnState) {
+	g.connsDown[origin] = !cs.Up
+	// a new connection starts with heartbeats alive
+	g.connsHung[origin] = false
+	log.Printf("=== %s", cs)
+	g.updateLost("conn state")
+}
+
+func (g *Guide) updateLost(reason string) {
+	unreachable := func(ref ActorRef) bool { return g.linksDown[ref] || g.connsDown[ref] || g.connsHung[ref] }
+	for li, l := range g.Layout.Lines {
+		lost := unreachable(g.lineActor(l.PowerConn))
+		if l.IsSwitch() {
+			lost = lost || unreachable(g.lineActor(l.SwitchConn))
+		}
+		g.lineStates[li].Lost = lost
+	}
+	for ti := range g.trains {
+		g.wakeup(ti, reason)
+	}
+}
+
+// handleEmergencyStop brakes all lines and zeroes the power of all trains, or lets trains run again if es.Reset.
+func (g *Guide) handleEmergencyStop(es GuideEmergencyStop) {
+	log.Printf("=== %s", es)
+	if es.Reset {
+		g.emergency = false
+		for ti := range g.trains {
+			g.wakeup(ti, "emergency stop reset")
+		}
+		return
+	}
+	g.emergency = true
+	for ti := range g.trains {
+		t := &g.trains[ti]
+		t.Power = 0
+		t.noPowerSupplied = true
+		t.History.AddSpan(Span{
+			Time:  g.clock.Now(),
+			Power: 0,
+		})
+	}
+	for li := range g.Layout.Lines {
+		g.brake(li)
+	}
+}
+
+// brake brakes the line li (regardless of which train has taken it).
+func (g *Guide) brake(li int) {
+	l := g.Layout.Lines[li]
+	rl := conn.ReqLine{Line: l.PowerConn.Line, Brake: true}
+	g.lineStates[li].Power = 0
+	if g.conf.Virtual {
+		log.Printf("brake virtual %s", rl)
+		return
+	}
+	g.actor.OutputCh <- Diffuse1{
+		Origin: g.lineActor(l.PowerConn),
+		Value:  rl,
+	}
+}
+
 func (g *Guide) handleAttitude(att Attitude) {
 	t := &g.trains[att.TrainI]
 	if att.TrainGeneration < t.Generation {
@@ -540,7 +706,7 @@ func (g *Guide) check(ti int) {
 }
 
 func (g *Guide) loop() {
-	time.Sleep(1 * time.Second)
+	g.clock.Sleep(1 * time.Second)
 	for ti := range g.trains {
 		g.wakeup(ti, "init")
 	}
@@ -559,10 +725,22 @@ func (g *Guide) loop() {
 			if err != nil {
 				panic(err)
 			}
+		case GuideEmergencyStop:
+			g.handleEmergencyStop(val)
 		case conn.ValCurrent:
 			g.handleValCurrent(diffuse, val)
+		case ValLinkState:
+			g.handleLinkState(val)
+		case conn.ValConnState:
+			g.handleConnState(diffuse.Origin, val)
+		case conn.ValCommandFailed:
+			g.handleCommandFailed(diffuse.Origin, val)
+		case conn.ValHeartbeat:
+			g.connsHung[diffuse.Origin] = !val.Alive
+			log.Printf("=== %s", val)
+			g.updateLost("heartbeat")
 		case conn.ValShortNotify:
-			c, ok := g.conf.actorsReverse[diffuse.Origin]
+			c, ok := g.actorConn(diffuse.Origin)
 			if !ok {
 				zap.S().Errorf("no conn for actor %s", diffuse.Origin)
 			}
@@ -585,6 +763,11 @@ func (g *Guide) loop() {
 }
 
 func (g *Guide) reify(ti int, t *Train) {
+	if g.emergency {
+		// all lines were braked by handleEmergencyStop
+		t.noPowerSupplied = true
+		return
+	}
 	power := t.Power
 	stop := false
 	max := t.TrailerFront
@@ -592,6 +775,12 @@ func (g *Guide) reify(ti int, t *Train) {
 		max += 1
 	}
 	for i := t.TrailerBack; i <= max; i++ {
+		if g.lineStates[t.Path.Follows[i].LineI].Lost {
+			log.Printf("=== STOP LOST")
+			stop = true
+			power = idlePower
+			break
+		}
 		if g.lineStates[t.Path.Follows[i].LineI].SwitchState == SwitchStateUnsafe && !t.RunOnLock {
 			log.Printf("=== STOP UNSAFE")
 			stop = true
@@ -724,7 +913,7 @@ func (g *Guide) applySwitch(ti int, t *Train, pathI int) {
 
 	//log.Printf("applySwitch")
 	d := Diffuse1{
-		Origin: g.conf.Actors[g.Layout.Lines[li].SwitchConn],
+		Origin: g.lineActor(g.Layout.Lines[li].SwitchConn),
 		Value: conn.ReqSwitch{
 			Line:      g.Layout.Lines[li].SwitchConn.Line,
 			Direction: targetState == SwitchStateB,
@@ -759,7 +948,7 @@ func (g *Guide) apply(t *Train, pathI int, power int) {
 		return
 	}
 	g.actor.OutputCh <- Diffuse1{
-		Origin: g.conf.Actors[l.PowerConn],
+		Origin: g.lineActor(l.PowerConn),
 		Value:  rl,
 	}
 	//log.Printf("apply2 %s", rl)
@@ -843,6 +1032,45 @@ type GuideTrainUpdate struct {
 	SetRunOnLock bool
 }
 
+// GuideEmergencyStop brakes every line and stops all trains.
+// Trains stay stopped until a GuideEmergencyStop with Reset; GuideTrainUpdates received in the meantime take effect after the reset.
+type GuideEmergencyStop struct {
+	Reset bool
+}
+
+func (es GuideEmergencyStop) String() string {
+	if es.Reset {
+		return "GuideEmergencyStop reset"
+	}
+	return "GuideEmergencyStop"
+}
+
+// EmergencyStopper sends GuideEmergencyStops to the guide through the runtime, for callers that are not actors (e.g. HTTP handlers, or runtime.InstanceConf.EmergencyStop).
+type EmergencyStopper struct {
+	guide ActorRef
+	out   chan Diffuse1
+}
+
+// NewEmergencyStopper returns an EmergencyStopper, and its actor (which must be added to the graph).
+func NewEmergencyStopper(guide ActorRef) (*EmergencyStopper, Actor) {
+	e := &EmergencyStopper{guide: guide, out: make(chan Diffuse1)}
+	return e, Actor{
+		Comment:  "emergency stopper",
+		OutputCh: e.out,
+		Type:     ActorType{Output: true},
+	}
+}
+
+// Send sends es to the guide, or gives up when ctx is done (e.g. when the runtime is not running).
+func (e *EmergencyStopper) Send(ctx context.Context, es GuideEmergencyStop) error {
+	select {
+	case e.out <- Diffuse1{Origin: e.guide, Value: es}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (gtu GuideTrainUpdate) String() string {
 	return fmt.Sprintf("GuideTrainUpdate %d %#v", gtu.TrainI, gtu)
 }
@@ -851,6 +1079,8 @@ type GuideSnapshot struct {
 	Trains     []Train
 	Layout     *layout.Layout
 	LineStates []LineStates
+	// EmergencyStop is true while trains are stopped by a GuideEmergencyStop.
+	EmergencyStop bool
 }
 
 func (gs GuideSnapshot) String() string {
@@ -863,7 +1093,7 @@ func (gs GuideSnapshot) String() string {
 }
 
 func (g *Guide) snapshot() GuideSnapshot {
-	gs := GuideSnapshot{Trains: g.trains, Layout: g.conf.Layout, LineStates: g.lineStates}
+	gs := GuideSnapshot{Trains: g.trains, Layout: g.conf.Layout, LineStates: g.lineStates, EmergencyStop: g.emergency}
 	buf := new(bytes.Buffer)
 	err := gob.NewEncoder(buf).Encode(gs)
 	if err != nil {
@@ -914,6 +1144,7 @@ func (g *Guide) publishChange(ti int, ct ChangeType) {
 	func() {
 		t := &g.trains[ti]
 		span := Span{
+			Time:  g.clock.Now(),
 			Power: t.Power,
 		}
 		zap.S().Infof("publishChange general train = %#v ; path = %s", t, t.Path)
@@ -1143,7 +1374,7 @@ func (g *Guide) TrainUpdate(gtu GuideTrainUpdate) (newGeneration int, err error)
 		pos, err := g.Layout.OffsetToPosition(*t.Path, g.Model2.CurrentOffset(t))
 		if err == nil {
 			newHistory.AddSpan(Span{
-				Time:             time.Now(),
+				Time:             g.clock.Now(),
 				AbsPosition:      pos,
 				AbsPositionKnown: true,
 			})
@@ -1160,6 +1391,7 @@ func (g *Guide) TrainUpdate(gtu GuideTrainUpdate) (newGeneration int, err error)
 	log.Printf("GuideTrainUpdate %#v", t)
 	log.Printf("GuideTrainUpdate.Path %#v", t.Path)
 	t.History.AddSpan(Span{
+		Time:  g.clock.Now(),
 		Power: t.Power,
 	})
 	g.calculateTrailers(t)
@@ -2,10 +2,15 @@ package tal
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/clock"
+	"nyiyui.ca/hato/sakayukari/conn"
 	. "nyiyui.ca/hato/sakayukari/prelude"
 	"nyiyui.ca/hato/sakayukari/tal/layout"
 )
@@ -39,3 +44,87 @@ func TestGobEncode(t *testing.T) {
 		t.Errorf("diff: %s", cmp.Diff(gs, res, cmp.AllowUnexported(Train{})))
 	}
 }
+
+func TestEmergencyStop(t *testing.T) {
+	y, err := layout.InitTestbench1()
+	if err != nil {
+		t.Fatalf("layout: %s", err)
+	}
+	actors := map[LineID]ActorRef{}
+	for i, l := range y.Lines {
+		actors[l.PowerConn] = ActorRef{Index: i}
+	}
+	g := &Guide{
+		conf:       GuideConf{Layout: y, Actors: actors},
+		Layout:     y,
+		lineStates: make([]LineStates, len(y.Lines)),
+		actor:      Actor{OutputCh: make(chan Diffuse1, len(y.Lines))},
+		clock:      clock.Real,
+	}
+	for li := range g.lineStates {
+		g.lineStates[li].Power = 70
+	}
+	g.handleEmergencyStop(GuideEmergencyStop{})
+	if !g.snapshot().EmergencyStop {
+		t.Fatal("not stopped")
+	}
+	for li, l := range y.Lines {
+		want := Diffuse1{Origin: ActorRef{Index: li}, Value: conn.ReqLine{Line: l.PowerConn.Line, Brake: true}}
+		if diff := cmp.Diff(want, <-g.actor.OutputCh); diff != "" {
+			t.Fatalf("line %d (-want +got):\n%s", li, diff)
+		}
+		if g.lineStates[li].Power != 0 {
+			t.Fatalf("line %d: power %d", li, g.lineStates[li].Power)
+		}
+	}
+	g.handleEmergencyStop(GuideEmergencyStop{Reset: true})
+	if g.snapshot().EmergencyStop {
+		t.Fatal("still stopped after reset")
+	}
+}
+
+func TestEmergencyStopVirtualClock(t *testing.T) {
+	y, err := layout.InitTestbench1()
+	if err != nil {
+		t.Fatalf("layout: %s", err)
+	}
+	start := time.Date(2023, 7, 20, 0, 0, 0, 0, time.UTC)
+	c := clock.NewVirtual(start)
+	g := &Guide{
+		conf:       GuideConf{Layout: y, Actors: map[LineID]ActorRef{}},
+		Layout:     y,
+		lineStates: make([]LineStates, len(y.Lines)),
+		actor:      Actor{OutputCh: make(chan Diffuse1, len(y.Lines))},
+		trains:     []Train{{Power: 70}},
+		clock:      c,
+	}
+	c.Advance(5 * time.Second)
+	g.handleEmergencyStop(GuideEmergencyStop{})
+	spans := g.trains[0].History.Spans
+	if len(spans) != 1 {
+		t.Fatalf("spans: %#v", spans)
+	}
+	// the span is at the guide's time, not the wall clock's
+	if want := start.Add(5 * time.Second); !spans[0].Time.Equal(want) {
+		t.Fatalf("span at %s, want %s", spans[0].Time, want)
+	}
+	if g.trains[0].Power != 0 {
+		t.Fatalf("power %d", g.trains[0].Power)
+	}
+}
+
+func TestEmergencyStopper(t *testing.T) {
+	guide := ActorRef{Index: 3}
+	es, a := NewEmergencyStopper(guide)
+	go es.Send(context.Background(), GuideEmergencyStop{Reset: true})
+	want := Diffuse1{Origin: guide, Value: GuideEmergencyStop{Reset: true}}
+	if diff := cmp.Diff(want, <-a.OutputCh); diff != "" {
+		t.Fatalf("(-want +got):\n%s", diff)
+	}
+	// gives up if the runtime is not running
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := es.Send(ctx, GuideEmergencyStop{}); err == nil {
+		t.Fatal("sent without a runtime")
+	}
+}
@@ -17,9 +17,13 @@ type History struct {
 	// SpanSets []SpanSet
 }
 
+// AddSpan adds s to the end of h.
+// s.Time must be set, from the guide's clock (see GuideConf.Clock).
 func (h *History) AddSpan(s Span) {
 	s.MustCheckInvariants()
-	s.Time = time.Now()
+	if s.Time.IsZero() {
+		panic("s.Time not set")
+	}
 	h.Spans = append(h.Spans, s)
 }
 
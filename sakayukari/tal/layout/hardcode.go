@@ -7,6 +7,18 @@ import (
 	"nyiyui.ca/hato/sakayukari/tal/layout/preset/kato"
 )
 
+// Hardcoded has the layouts in this file by name (e.g. for config files).
+var Hardcoded = map[string]func() (*Layout, error){
+	"testbench1":  InitTestbench1,
+	"testbench2":  InitTestbench2,
+	"testbench3":  InitTestbench3,
+	"testbench4":  InitTestbench4,
+	"testbench5":  InitTestbench5,
+	"testbench6":  InitTestbench6,
+	"testbench6b": InitTestbench6b,
+	"testbench6c": InitTestbench6c,
+}
+
 func InitTestbench1() (*Layout, error) {
 	breadboard := func(line string) LineID {
 		return LineID{
@@ -9,6 +9,7 @@ import (
 	"golang.org/x/exp/slices"
 
 	. "nyiyui.ca/hato/sakayukari"
+	"nyiyui.ca/hato/sakayukari/clock"
 	"nyiyui.ca/hato/sakayukari/conn"
 	. "nyiyui.ca/hato/sakayukari/prelude"
 	"nyiyui.ca/hato/sakayukari/tal/cars"
@@ -39,6 +40,8 @@ type ModelConf struct {
 	Cars  cars.Data
 	Guide ActorRef
 	RFIDs []RFID
+	// Clock is used for attitudes. If nil, clock.Real is used.
+	Clock clock.Clock
 }
 
 type RFID struct {
@@ -56,6 +59,7 @@ type model struct {
 	// currentAttitudes is the delta-updated attitudes derived from latestAttitudes.
 	// This is to make sure the error is not going to increase every iteration of the handleDelta method.
 	currentAttitudes []Attitude
+	clock            clock.Clock
 }
 
 func Model(conf ModelConf) *Actor {
@@ -74,6 +78,7 @@ func Model(conf ModelConf) *Actor {
 		conf:  conf,
 		actor: a,
 		rfid:  map[ActorRef]int{},
+		clock: clock.Or(conf.Clock),
 	}
 	a.Inputs = append(a.Inputs, conf.Guide)
 	for i, rfid := range conf.RFIDs {
@@ -85,7 +90,7 @@ func Model(conf ModelConf) *Actor {
 }
 
 func (m *model) loop() {
-	prev := time.Now()
+	prev := m.clock.Now()
 	_ = prev
 	for {
 		select {
@@ -121,7 +126,7 @@ func (m *model) loop() {
 				log.Printf("tal-model: unhandled diffuse %s", diffuse)
 			}
 		default:
-			now := time.Now()
+			now := m.clock.Now()
 			m.handleDelta(now, prev.Sub(now))
 			prev = now
 		}
@@ -266,7 +271,11 @@ func (m *model) handleAttitude(diffuse Diffuse1) {
 func (m *model) handleRFID(diffuse Diffuse1) {
 	log.Printf("diffuse! %#v", diffuse)
 	ri := m.rfid[diffuse.Origin]
-	seen := diffuse.Value.(conn.ValSeen)
+	seen, ok := diffuse.Value.(conn.ValSeen)
+	if !ok {
+		// e.g. conn.ValConnState
+		return
+	}
 	if len(seen.ID) != 1 {
 		panic(fmt.Sprintf("got non-1-length ValSeen.ID: %#v", seen))
 	}
@@ -383,7 +392,7 @@ OuterLoop:
 	a := Attitude{
 		TrainI:          ti,
 		TrainGeneration: t.Generation,
-		Time:            time.Now(),
+		Time:            m.clock.Now(),
 		Position:        sideAPos,
 		PositionKnown:   true,
 	}
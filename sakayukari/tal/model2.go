@@ -8,7 +8,6 @@ import (
 	"math"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/google/uuid"
 	"github.com/openacid/slimarray/polyfit"
@@ -205,7 +204,7 @@ func (m *Model2) CurrentOffset(t *Train) int64 {
 	}
 	fd.UpdateRelation()
 	m.forms[t.FormI] = fd
-	offset, ok := t.History.Extrapolate(m.g.Layout, *t.Path, fd.Relation, time.Now())
+	offset, ok := t.History.Extrapolate(m.g.Layout, *t.Path, fd.Relation, m.g.clock.Now())
 	if !ok {
 		return -1
 	}
@@ -102,9 +102,12 @@ func (tp *TrainPlanner) QuadraticEdgePlan(qep QuadraticEdgePlan, etaCh chan<- ti
 	targetOffset := tp.p.g.Layout.PositionToOffset(*t.Path, qep.End.Position)
 
 	var lastAccelVel int64
-	startAccelTime := time.Now()
-	for range time.NewTicker(generalInterval).C {
-		lastAccelVel = qep.Start.Velocity + qep.Acceleration*time.Since(startAccelTime).Milliseconds()/1000
+	clock := tp.p.g.Clock()
+	startAccelTime := clock.Now()
+	accelTicker := clock.NewTicker(generalInterval)
+	defer accelTicker.Stop()
+	for range accelTicker.C {
+		lastAccelVel = qep.Start.Velocity + qep.Acceleration*clock.Since(startAccelTime).Milliseconds()/1000
 		power, ok = fd.Relation.SolveForX(float64(lastAccelVel))
 		if !ok {
 			panic(fmt.Sprintf("no power can be given to attain end velocity of %d µm/s (intermediate velocity)", qep.Velocity))
@@ -131,9 +134,11 @@ func (tp *TrainPlanner) QuadraticEdgePlan(qep QuadraticEdgePlan, etaCh chan<- ti
 		}
 	}
 	var lastDecelVel int64
-	startDecelTime := time.Now()
-	for range time.NewTicker(generalInterval).C {
-		lastDecelVel = lastAccelVel - qep.Deceleration*time.Since(startDecelTime).Milliseconds()/1000
+	startDecelTime := clock.Now()
+	decelTicker := clock.NewTicker(generalInterval)
+	defer decelTicker.Stop()
+	for range decelTicker.C {
+		lastDecelVel = lastAccelVel - qep.Deceleration*clock.Since(startDecelTime).Milliseconds()/1000
 		power, ok = fd.Relation.SolveForX(float64(lastDecelVel))
 		if !ok {
 			panic(fmt.Sprintf("no power can be given to attain end velocity of %d µm/s (intermediate velocity)", qep.Velocity))
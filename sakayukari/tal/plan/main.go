@@ -133,7 +133,7 @@ func (tp *TrainPlanner) LinearPlan(lp LinearPlan, etaCh chan<- time.Time) error
 				currentOffset := tp.p.g.Layout.PositionToOffset(*t.Path, pos)
 				distance := targetOffset - currentOffset
 				duration := distance * 1000 / lp.Start.Velocity // use velocity from model
-				eta := time.Now().Add(time.Duration(duration) * time.Millisecond)
+				eta := tp.p.g.Clock().Now().Add(time.Duration(duration) * time.Millisecond)
 				//zap.S().Debugf("eta: %s", eta)
 				etaCh <- eta
 			case <-stopCh:
@@ -146,7 +146,9 @@ func (tp *TrainPlanner) LinearPlan(lp LinearPlan, etaCh chan<- time.Time) error
 	{
 		var targetOffset int64
 		var targetOffsetSet bool
-		for range time.NewTicker(generalInterval).C {
+		ticker := tp.p.g.Clock().NewTicker(generalInterval)
+		defer ticker.Stop()
+		for range ticker.C {
 			gs := tp.p.g.SnapshotMux.Current()
 			t := gs.Trains[tp.trainI]
 			if t.Generation < newGeneration {
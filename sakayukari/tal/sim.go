@@ -1,6 +1,7 @@
 package tal
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -64,7 +65,9 @@ func (ep EventPower) String() string {
 	return fmt.Sprintf("set power %d to line %d", ep.Power, ep.LineI)
 }
 
-func (s *Simulator) GenActorRefs(newActor func(a Actor) ActorRef) map[layout.LineID]ActorRef {
+// GenActorRefs makes an actor simulating each device of the guide's layout, and returns the actors for all lines.
+// newActor is called with each device's id and its simulated actor, and returns the actor's ref (e.g. after replacing the device's actor with runtime.Instance.ReplaceActor).
+func (s *Simulator) GenActorRefs(newActor func(c conn.Id, a Actor) ActorRef) map[layout.LineID]ActorRef {
 	res := map[layout.LineID]ActorRef{}
 	s.conns = map[conn.Id]ActorRef{}
 	ensureConn := func(l LineID) {
@@ -84,7 +87,7 @@ func (s *Simulator) GenActorRefs(newActor func(a Actor) ActorRef) map[layout.Lin
 					Output:      true,
 				},
 			}
-			s.conns[c] = newActor(a)
+			s.conns[c] = newActor(c, a)
 			ref = s.conns[c]
 			s.actors = append(s.actors, ActorAndRef{a, ref})
 		}
@@ -98,19 +101,21 @@ func (s *Simulator) GenActorRefs(newActor func(a Actor) ActorRef) map[layout.Lin
 	return res
 }
 
-func (s *Simulator) Run() {
+// Run starts the simulation, which runs until ctx is done.
+// The simulation uses the clock of the guide (see GuideConf.Clock), so it can run faster than real time.
+func (s *Simulator) Run(ctx context.Context) {
 	s.g.Model2.SetIgnoreWrites()
 	s.lineStates = make([]lineState, len(s.g.Layout.Lines))
 	s.trainStates = make([]trainState, len(s.g.trains))
-	go s.logEvents()
+	go s.logEvents(ctx)
 	for i := range s.actors {
-		go s.handleActorOutput(i)
-		go s.handleActorInput(i)
+		go s.handleActorOutput(ctx, i)
+		go s.handleActorInput(ctx, i)
 	}
-	go s.simulateTrains()
+	go s.simulateTrains(ctx)
 }
 
-func (s *Simulator) handleActorOutput(i int) {
+func (s *Simulator) handleActorOutput(ctx context.Context, i int) {
 	aar := s.actors[i]
 	current := map[string]bool{}
 	current["A"] = false
@@ -124,7 +129,13 @@ func (s *Simulator) handleActorOutput(i int) {
 	ch := make(chan Event)
 	s.events.Subscribe(fmt.Sprintf("actor %d", i), ch)
 	defer s.events.Unsubscribe(ch)
-	for ev := range ch {
+	for {
+		var ev Event
+		select {
+		case ev = <-ch:
+		case <-ctx.Done():
+			return
+		}
 		switch ev := ev.(type) {
 		case EventEntryExit:
 			line := s.g.Layout.Lines[ev.LineI]
@@ -146,14 +157,18 @@ func (s *Simulator) handleActorOutput(i int) {
 			}
 			vc.Sort()
 			zap.S().Infof("send: %s", Diffuse1{Value: vc})
-			aar.Actor.OutputCh <- Diffuse1{Value: vc}
+			select {
+			case aar.Actor.OutputCh <- Diffuse1{Value: vc}:
+			case <-ctx.Done():
+				return
+			}
 		default:
 			continue
 		}
 	}
 }
 
-func (s *Simulator) handleActorInput(i int) {
+func (s *Simulator) handleActorInput(ctx context.Context, i int) {
 	aar := s.actors[i]
 	for diffuse := range aar.Actor.InputCh {
 		connId, ok := s.connsReverse[aar.Ref]
@@ -177,7 +192,7 @@ func (s *Simulator) handleActorInput(i int) {
 				s.lineStates[lineI].SwitchState = SwitchStateUnsafe
 			}()
 			goalSwitchState := map[bool]SwitchState{true: SwitchStateB, false: SwitchStateC}[val.Direction]
-			timer := time.NewTimer(time.Duration(val.Duration) * time.Millisecond)
+			timer := s.g.clock.NewTimer(time.Duration(val.Duration) * time.Millisecond)
 			go func() {
 				<-timer.C
 				s.lineStates[lineI].Lock.Lock()
@@ -186,11 +201,14 @@ func (s *Simulator) handleActorInput(i int) {
 				diffuse := Diffuse1{
 					Value: conn.ValShortNotify{
 						Line:      val.Line,
-						Monotonic: time.Now().UnixMilli(), // not monotonic but should be good enough (I don't think it's used anyways)
+						Monotonic: s.g.clock.Now().UnixMilli(), // not monotonic but should be good enough (I don't think it's used anyways)
 					},
 				}
 				zap.S().Infof("send: %s", diffuse)
-				aar.Actor.OutputCh <- diffuse
+				select {
+				case aar.Actor.OutputCh <- diffuse:
+				case <-ctx.Done():
+				}
 			}()
 		case conn.ReqLine:
 			li := LineID{connId, val.Line}
@@ -220,13 +238,20 @@ type trainState struct {
 	Train    Train
 }
 
-func (s *Simulator) simulateTrains() {
+func (s *Simulator) simulateTrains(ctx context.Context) {
 	snap := s.g.snapshot()
 	for i := range s.g.trains {
 		s.trainStates[i].Train = snap.Trains[i]
 	}
 	stepI := 0
-	for range time.NewTicker(100 * time.Millisecond).C {
+	ticker := s.g.clock.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
 		s.step(stepI)
 		stepI++
 	}
@@ -356,11 +381,16 @@ type lineState struct {
 	SwitchState SwitchState
 }
 
-func (s *Simulator) logEvents() {
+func (s *Simulator) logEvents(ctx context.Context) {
 	ch := make(chan Event)
 	s.events.Subscribe("logEvents", ch)
 	defer s.events.Unsubscribe(ch)
-	for ev := range ch {
-		zap.S().Infof("new event: %s", ev)
+	for {
+		select {
+		case ev := <-ch:
+			zap.S().Infof("new event: %s", ev)
+		case <-ctx.Done():
+			return
+		}
 	}
 }
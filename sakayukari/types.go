@@ -65,12 +65,17 @@ type Actor struct {
 	// GetValue func() Value
 
 	Type ActorType
+
+	// Done, if not nil, is closed by the actor when it has finished cleaning up after its InputCh was closed by the runtime.
+	// The runtime waits for Done (for a limited time) when shutting down, before closing the InputChs of the actors this actor depends on.
+	Done chan struct{}
 }
 
 type ActorType struct {
 	Input  bool
 	Output bool
-	// LinearInput (NOT IMPLEMENTED YET!) ensures the actor's InputCh are input linearly.
+	// LinearInput ensures the actor's InputCh receives diffuses in the order the runtime received them.
+	// Diffuses are queued per actor, so a slow LinearInput actor does not block other actors.
 	LinearInput bool
 }
 
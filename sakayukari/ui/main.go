@@ -1,8 +1,8 @@
 package ui
 
 import (
+	"context"
 	"fmt"
-	"log"
 
 	"github.com/gizak/termui/v3"
 	"github.com/gizak/termui/v3/widgets"
@@ -17,25 +17,28 @@ func Main() error {
 		return fmt.Errorf("termui init: %s", err)
 	}
 	defer termui.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	g := Graph{
 		Actors: []Actor{
-			uiEvents(),
+			uiEvents(cancel),
 			latestKey(ActorRef{Index: 0}),
 		},
 	}
-	i := runtime.NewInstance(&g)
+	i := runtime.NewInstance(&g, runtime.InstanceConf{})
 	err = i.Check()
 	if err != nil {
 		return fmt.Errorf("check: %s", err)
 	}
-	err = i.Diffuse()
+	err = i.Diffuse(ctx)
 	if err != nil {
 		return fmt.Errorf("diffuse: %s", err)
 	}
 	return nil
 }
 
-func uiEvents() Actor {
+// uiEvents emits UIEvents, and calls cancel on <C-c>.
+func uiEvents(cancel context.CancelFunc) Actor {
 	a := Actor{
 		Comment:  "uiEvents",
 		OutputCh: make(chan Diffuse1),
@@ -46,7 +49,8 @@ func uiEvents() Actor {
 	go func() {
 		for e := range termui.PollEvents() {
 			if e.ID == "<C-c>" {
-				log.Fatalf("interrupt") // TODO: cleanup when exiting
+				cancel()
+				return
 			}
 			a.OutputCh <- Diffuse1{
 				Value: UIEvent{e},
@@ -58,6 +62,10 @@ func uiEvents() Actor {
 
 type UIEvent struct{ E termui.Event }
 
+func init() {
+	RegisterValue("ui.UIEvent", UIEvent{})
+}
+
 func (u UIEvent) String() string {
 	return fmt.Sprint(u.E)
 }
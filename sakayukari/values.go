@@ -0,0 +1,74 @@
+package sakayukari
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	valueTypesLock sync.RWMutex
+	valueTypes     = map[string]reflect.Type{}
+	valueNames     = map[reflect.Type]string{}
+)
+
+// RegisterValue registers the concrete type of v under name, so that values of that type can be decoded (e.g. from a trace).
+// This is usually called from an init function of the package defining the type.
+func RegisterValue(name string, v Value) {
+	t := reflect.TypeOf(v)
+	valueTypesLock.Lock()
+	defer valueTypesLock.Unlock()
+	if t2, ok := valueTypes[name]; ok && t2 != t {
+		panic(fmt.Sprintf("value name %s already registered for %s", name, t2))
+	}
+	valueTypes[name] = t
+	valueNames[t] = name
+}
+
+// ValueName returns the name v's type was registered under.
+func ValueName(v Value) (name string, ok bool) {
+	valueTypesLock.RLock()
+	defer valueTypesLock.RUnlock()
+	name, ok = valueNames[reflect.TypeOf(v)]
+	return
+}
+
+// DecodeValue decodes JSON-encoded data into a new value of the type registered under name.
+func DecodeValue(name string, data []byte) (Value, error) {
+	valueTypesLock.RLock()
+	t, ok := valueTypes[name]
+	valueTypesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("value type %s not registered", name)
+	}
+	p := reflect.New(t)
+	err := json.Unmarshal(data, p.Interface())
+	if err != nil {
+		return nil, fmt.Errorf("value type %s: %w", name, err)
+	}
+	return p.Elem().Interface().(Value), nil
+}
+
+func init() {
+	RegisterValue("sakayukari.Message", Message(""))
+	// traces made before ValLinkState moved here use its old name
+	RegisterValue("runtime.ValLinkState", ValLinkState{})
+	RegisterValue("sakayukari.ValLinkState", ValLinkState{})
+}
+
+// ValLinkState is published (e.g. by runtime.Export and runtime.Import) when a link to another runtime goes up or down.
+type ValLinkState struct {
+	Addr string
+	Up   bool
+	// Actors are the local actors that are only reachable over the link (the exported actors for Export, and the proxies for Import).
+	Actors []ActorRef
+}
+
+func (v ValLinkState) String() string {
+	state := "down"
+	if v.Up {
+		state = "up"
+	}
+	return fmt.Sprintf("link %s %s (actors %v)", v.Addr, state, v.Actors)
+}